@@ -3,25 +3,35 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/lmuench/gorialize/gorialize"
 )
 
 func main() {
-	argCnt := len(os.Args) - 1
+	args, keys, newKeys, decrypt, err := ParseKeyFlags(os.Args[1:])
+	if err != nil {
+		fmt.Println(err)
+		PrintHelpText()
+	}
+	argCnt := len(args)
 	if argCnt < 2 {
 		PrintHelpText()
 		return
 	}
-	args := os.Args[1:]
 
-	var err error
 	command := args[0]
 	path := args[1]
 
 	switch command {
 	case "show", "s":
-		err = HandleShowCommand(command, path, args, argCnt)
+		err = HandleShowCommand(command, path, args, argCnt, keys)
+	case "reindex":
+		err = gorialize.ReindexWith(path, keys)
+	case "rekey":
+		err = gorialize.Rekey(path, keys, newKeys, decrypt)
+	case "prune-keys":
+		err = gorialize.PruneKeys(path, keys)
 	default:
 		PrintHelpText()
 	}
@@ -30,12 +40,102 @@ func main() {
 	}
 }
 
-func HandleShowCommand(command string, path string, args []string, argCnt int) error {
+// ParseKeyFlags removes the key flags from the arguments and returns the key
+// providers they select and whether --decrypt is given. The providers are nil
+// if no flag selects them.
+func ParseKeyFlags(args []string) (rest []string, keys gorialize.KeyProvider, newKeys gorialize.KeyProvider, decrypt bool, err error) {
+	for i := 0; i < len(args); i++ {
+		name, value := args[i], ""
+		if !strings.HasPrefix(name, "--") {
+			rest = append(rest, name)
+			continue
+		}
+		if name == "--decrypt" {
+			decrypt = true
+			continue
+		}
+		if eq := strings.Index(name, "="); eq >= 0 {
+			name, value = name[:eq], name[eq+1:]
+		} else if i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		if strings.TrimSpace(value) == "" {
+			return nil, nil, nil, false, fmt.Errorf("Flag %s needs a value", name)
+		}
+
+		var provider gorialize.KeyProvider
+		switch strings.TrimPrefix(strings.TrimPrefix(name, "--"), "new-") {
+		case "key-file":
+			provider = gorialize.KeyFile(value)
+		case "key-cmd":
+			command, splitErr := SplitCommand(value)
+			if splitErr != nil {
+				return nil, nil, nil, false, fmt.Errorf("Flag %s: %v", name, splitErr)
+			}
+			provider = gorialize.CommandPassphrase(command[0], command[1:]...)
+		default:
+			return nil, nil, nil, false, fmt.Errorf("Unknown flag %s", name)
+		}
+		if strings.HasPrefix(name, "--new-") {
+			newKeys = provider
+		} else {
+			keys = provider
+		}
+	}
+	return rest, keys, newKeys, decrypt, nil
+}
+
+// SplitCommand splits a command line at spaces like a shell. Arguments
+// containing spaces are quoted with single or double quotes, or the spaces
+// are escaped with a backslash.
+func SplitCommand(command string) ([]string, error) {
+	args := []string{}
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range command {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, fmt.Errorf("Unterminated quote or escape in %q", command)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+func HandleShowCommand(command string, path string, args []string, argCnt int, keys gorialize.KeyProvider) error {
 	if argCnt < 3 {
-		return gorialize.ShowAll(path)
+		return gorialize.ShowAllWith(path, keys)
 	}
 	filename := args[2]
-	return gorialize.ShowOne(path, filename)
+	return gorialize.ShowOneWith(path, filename, keys)
 }
 
 func PrintHelpText() {
@@ -43,6 +143,18 @@ func PrintHelpText() {
   Commands:
     show [directory path]                             Show a directory's resources
     show [directory path] [resource ID]               Show a single resource
+    reindex [directory path]                          Rebuild the index of all models
+    rekey [directory path]                            Re-encrypt a directory with GORIALIZE_NEW_PASS
+    rekey --decrypt [directory path]                  Decrypt a directory
+    prune-keys [directory path]                       Drop the previous keys kept by rekey
+
+  Flags:
+    --key-file [path]                                 Read the raw 32 byte key from a file
+    --key-cmd [command]                               Read the passphrase from a command's output,
+                                                      quote arguments containing spaces
+    --new-key-file [path], --new-key-cmd [command]    Select the new key of rekey
+
+  Without flags the passphrase is read from GORIALIZE_PASS.
 	`)
 	os.Exit(1)
 }
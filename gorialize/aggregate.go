@@ -0,0 +1,298 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Aggregate holds the number of resources of a group and the sum, minimum and
+// maximum of their values of the aggregated field.
+type Aggregate struct {
+	Count int
+	Sum   float64
+	Min   float64
+	Max   float64
+}
+
+// Avg returns the average of the aggregated values, or 0 if there are none.
+func (a Aggregate) Avg() float64 {
+	if a.Count == 0 {
+		return 0
+	}
+	return a.Sum / float64(a.Count)
+}
+
+func (a *Aggregate) add(value float64) {
+	if a.Count == 0 || value < a.Min {
+		a.Min = value
+	}
+	if a.Count == 0 || value > a.Max {
+		a.Max = value
+	}
+	a.Count++
+	a.Sum += value
+}
+
+// Count returns the number of resources of the given type matching the where
+// clauses, expressions and filters, or of all resources if there are none.
+// Where clauses on indexed fields are answered from the index and otherwise
+// from the directory listing without decoding any resource.
+func (dir Directory) Count(resource interface{}, options ...QueryOption) (int, error) {
+	defer dir.lockModel(modelOf(resource), false)()
+
+	q := dir.newQueryWithoutID("count", resource)
+	q.StartPlan(nil)
+	defer q.FinishPlan()
+	q.ApplyOptions(options)
+	q.ExitIfPagination()
+	q.ReflectTypeOfResource()
+	q.ReflectModelNameFromType()
+	q.BuildDirPath()
+	q.ThwartIOBasePathEscape()
+	q.RefreshIndex()
+	q.MatchIDsForAggregation()
+	q.Log()
+	return len(q.MatchedIDs), q.Err()
+}
+
+// Exists reports whether any resource of the given type matches the where
+// clauses, expressions and filters.
+func (dir Directory) Exists(resource interface{}, options ...QueryOption) (bool, error) {
+	n, err := dir.Count(resource, options...)
+	return n > 0, err
+}
+
+// Aggregate returns the number of matching resources and the sum, minimum and
+// maximum of their values of a numeric field.
+func (dir Directory) Aggregate(resource interface{}, field string, options ...QueryOption) (Aggregate, error) {
+	groups, err := dir.aggregate("aggregate", resource, "", field, options, false)
+	return groups[""], err
+}
+
+// Sum returns the sum of a numeric field of the matching resources.
+func (dir Directory) Sum(resource interface{}, field string, options ...QueryOption) (float64, error) {
+	a, err := dir.Aggregate(resource, field, options...)
+	return a.Sum, err
+}
+
+// Min returns the minimum of a numeric field of the matching resources. It
+// fails with ErrNoMatches if no resource matches.
+func (dir Directory) Min(resource interface{}, field string, options ...QueryOption) (float64, error) {
+	groups, err := dir.aggregate("min", resource, "", field, options, true)
+	return groups[""].Min, err
+}
+
+// Max returns the maximum of a numeric field of the matching resources. It
+// fails with ErrNoMatches if no resource matches.
+func (dir Directory) Max(resource interface{}, field string, options ...QueryOption) (float64, error) {
+	groups, err := dir.aggregate("max", resource, "", field, options, true)
+	return groups[""].Max, err
+}
+
+// Avg returns the average of a numeric field of the matching resources. It
+// fails with ErrNoMatches if no resource matches.
+func (dir Directory) Avg(resource interface{}, field string, options ...QueryOption) (float64, error) {
+	groups, err := dir.aggregate("avg", resource, "", field, options, true)
+	return groups[""].Avg(), err
+}
+
+// GroupBy groups the matching resources by the value of groupField and
+// aggregates the values of the numeric valueField per group. The groups are
+// keyed by the group field's value formatted as in the index, e.g. "42",
+// "true" or "active". With an empty valueField only the resources are counted.
+func (dir Directory) GroupBy(resource interface{}, groupField string, valueField string, options ...QueryOption) (map[string]Aggregate, error) {
+	return dir.aggregate("group by", resource, groupField, valueField, options, false)
+}
+
+func (dir Directory) aggregate(operation string, resource interface{}, groupField string, valueField string, options []QueryOption, requireMatches bool) (map[string]Aggregate, error) {
+	defer dir.lockModel(modelOf(resource), false)()
+
+	q := dir.newQueryWithoutID(operation, resource)
+	q.StartPlan(nil)
+	defer q.FinishPlan()
+	q.ApplyOptions(options)
+	q.ExitIfPagination()
+	q.ReflectTypeOfResource()
+	q.ReflectModelNameFromType()
+	q.BuildDirPath()
+	q.ThwartIOBasePathEscape()
+	q.RefreshIndex()
+	q.MatchIDsForAggregation()
+	q.AggregateMatchedIDs(groupField, valueField)
+	if q.FatalError == nil && requireMatches && q.Groups[""].Count == 0 {
+		q.FatalError = ErrNoMatches
+	}
+	q.Log()
+	return q.Groups, q.Err()
+}
+
+// MatchIDsForAggregation matches the IDs of the resources matching the
+// query's where clauses, expressions and filters, or of all resources in the
+// directory listing if there are none. Unlike ApplyWhereClauses it doesn't
+// fail if nothing matches.
+func (q *Query) MatchIDsForAggregation() {
+	if q.FatalError != nil {
+		return
+	}
+	if len(q.WhereClauses) == 0 && len(q.Exprs) == 0 && len(q.Filters) == 0 {
+		q.MatchedIDs, q.FatalError = q.allIDs()
+	} else {
+		q.ApplyWhereClauses()
+	}
+	if q.FatalError == ErrNoMatches {
+		q.FatalError = nil
+		q.MatchedIDs = q.MatchedIDs[:0]
+	}
+	if q.plan != nil {
+		q.plan.Matched = len(q.MatchedIDs)
+	}
+}
+
+// AggregateMatchedIDs aggregates the matched resources' values of a numeric
+// field per value of the group field. Both fields are read from the index if
+// they are indexed and otherwise from the decoded resources, one at a time.
+// Resources without a value, e.g. because of a nil pointer along the field's
+// path, are skipped.
+func (q *Query) AggregateMatchedIDs(groupField string, valueField string) {
+	if q.FatalError != nil {
+		return
+	}
+	q.Groups = map[string]Aggregate{}
+	if groupField == "" {
+		q.Groups[""] = Aggregate{}
+	}
+
+	var group, value *fieldPath
+	if groupField != "" {
+		fp, err := lookupField(q.ResourceType, groupField)
+		if err == nil && fp.multi {
+			err = fmt.Errorf("Field %s has multiple values and can't be grouped by", groupField)
+		}
+		if err != nil {
+			q.FatalError = err
+			return
+		}
+		group = &fp
+	}
+	kind := orderNone
+	if valueField != "" {
+		fp, err := lookupField(q.ResourceType, valueField)
+		if err == nil && fp.multi {
+			err = fmt.Errorf("Field %s has multiple values and can't be aggregated", valueField)
+		}
+		if err != nil {
+			q.FatalError = err
+			return
+		}
+		kind = orderKindOf(fp.typ)
+		if kind != orderInt && kind != orderUint && kind != orderFloat {
+			q.FatalError = fmt.Errorf("Field %s of type %s isn't numeric", valueField, fp.typ)
+			return
+		}
+		value = &fp
+	}
+
+	add := func(groupValue string, formatted string) error {
+		a := q.Groups[groupValue]
+		if value == nil {
+			a.Count++
+		} else {
+			v, err := parseOrdered(kind, formatted)
+			if err != nil {
+				return err
+			}
+			a.add(numericValue(kind, v))
+		}
+		q.Groups[groupValue] = a
+		return nil
+	}
+
+	groupValues, groupsIndexed := q.indexedValues(group)
+	values, valuesIndexed := q.indexedValues(value)
+	if groupsIndexed && valuesIndexed {
+		for _, id := range q.MatchedIDs {
+			q.FatalError = add(groupValues[id], values[id])
+			if q.FatalError != nil {
+				return
+			}
+		}
+		return
+	}
+
+	for _, id := range q.MatchedIDs {
+		candidate := reflect.New(q.ResourceType.Elem()).Interface()
+		err := q.read(candidate, id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			q.FatalError = err
+			return
+		}
+		val := reflect.ValueOf(candidate).Elem()
+		groupValue, formatted := "", ""
+		if group != nil {
+			groupValues := group.values(val)
+			if len(groupValues) == 0 {
+				continue
+			}
+			groupValue = group.normalize(formatIndexValue(groupValues[0]))
+		}
+		if value != nil {
+			values := value.values(val)
+			if len(values) == 0 {
+				continue
+			}
+			formatted = formatIndexValue(values[0])
+		}
+		q.FatalError = add(groupValue, formatted)
+		if q.FatalError != nil {
+			return
+		}
+	}
+}
+
+// indexedValues returns the indexed values of a field of the matched
+// resources formatted as in the index. ok is false if the field isn't indexed
+// or a matched resource doesn't have exactly one indexed value. A nil field has
+// no values and is always ok.
+func (q *Query) indexedValues(fp *fieldPath) (values map[int]string, ok bool) {
+	if fp == nil {
+		return nil, true
+	}
+	if q.Reader != nil || !fp.tag.indexed {
+		return nil, false
+	}
+	return q.Dir.Index.fieldValues(q.Model, fp.name, q.MatchedIDs)
+}
+
+// fieldValues returns the unescaped index values of a field of the resources
+// with the given IDs, or ok false if one of them doesn't have exactly one.
+func (idx Index) fieldValues(model string, field string, ids []int) (values map[int]string, ok bool) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	prefix := model + ":" + field + ":"
+	values = make(map[int]string, len(ids))
+	for _, id := range ids {
+		keys := idx.VK[makeVal(model, field, id)]
+		if len(keys) != 1 || !strings.HasPrefix(keys[0], prefix) {
+			return nil, false
+		}
+		values[id] = unescapeIndexValue(keys[0][len(prefix):])
+	}
+	return values, true
+}
+
+func numericValue(kind orderKind, v orderedValue) float64 {
+	switch kind {
+	case orderInt:
+		return float64(v.i)
+	case orderUint:
+		return float64(v.u)
+	}
+	return v.f
+}
@@ -7,26 +7,50 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/drosseau/degob"
 )
 
+const (
+	decryptFailedText = "Failed to decrypt with the given key file, key command or GORIALIZE_PASS environment variable."
+	decodeFailedText  = "Failed to decode gob. If directory is encrypted pass --key-file or --key-cmd or set GORIALIZE_PASS environment variable."
+)
+
+// cliKeyProvider returns keys or, if it is nil, a provider reading the
+// passphrase from the environment variable if it is set.
+func cliKeyProvider(keys KeyProvider, env string) KeyProvider {
+	if keys == nil && os.Getenv(env) != "" {
+		return EnvPassphrase(env)
+	}
+	return keys
+}
+
 // ShowOne prints a gob file's contents to the console.
 // It does not need the corresponding struct to decode the gob file.
+// The passphrase is read from the GORIALIZE_PASS environment variable.
 func ShowOne(dirPath string, filename string) error {
-	passphrase := os.Getenv("GORIALIZE_PASS")
-	dir := NewDirectory(DirectoryConfig{
-		Encrypted:  passphrase != "",
-		Passphrase: passphrase,
-		Log:        false,
-	})
+	return ShowOneWith(dirPath, filename, nil)
+}
+
+// ShowOneWith is like ShowOne but takes the key from the key provider, which
+// defaults to the GORIALIZE_PASS environment variable.
+func ShowOneWith(dirPath string, filename string, keys KeyProvider) error {
+	dir, model, err := openShowDirectory(dirPath, keys)
+	if err != nil {
+		return err
+	}
 
 	id, err := strconv.Atoi(filename)
 	if err != nil {
 		return errors.New("Resource ID parameter must be a number")
 	}
 	q := dir.newQueryWithID("show", nil, id)
+	q.Model = model
 	q.DirPath = dirPath
 	q.ThwartIOBasePathEscape()
 	q.ExitIfDirNotExist()
@@ -34,8 +58,8 @@ func ShowOne(dirPath string, filename string) error {
 	q.ReadGobFromDisk()
 	q.DecryptGobBuffer()
 	if q.FatalError != nil {
-		if q.FatalError.Error()[:6] == "cipher" {
-			fmt.Println("Failed to decrypt with GORIALIZE_PASS environment variable.")
+		if errors.Is(q.FatalError, ErrDecrypt) {
+			fmt.Println(decryptFailedText)
 		}
 		return q.FatalError
 	}
@@ -43,7 +67,7 @@ func ShowOne(dirPath string, filename string) error {
 	dec := degob.NewDecoder(reader)
 	gobs, err := dec.Decode()
 	if err != nil {
-		fmt.Println("Failed to decode gob. If directory is encrypted set GORIALIZE_PASS environment variable.")
+		fmt.Println(decodeFailedText)
 		return err
 	}
 	for _, g := range gobs {
@@ -55,20 +79,51 @@ func ShowOne(dirPath string, filename string) error {
 	return nil
 }
 
+// openShowDirectory opens the directory a model directory belongs to for
+// reading only and returns the model's name. The key is derived without
+// writing key parameters or migrating the directory.
+func openShowDirectory(dirPath string, keys KeyProvider) (*Directory, string, error) {
+	dir, err := OpenDirectory(DirectoryConfig{Log: false})
+	if err != nil {
+		return nil, "", err
+	}
+	keys = cliKeyProvider(keys, "GORIALIZE_PASS")
+	if keys != nil {
+		material, err := keys.ProvideKey()
+		if err != nil {
+			return nil, "", err
+		}
+		err = dir.readKey(filepath.Dir(filepath.Clean(dirPath)), material)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	model, _, err := dir.readSchema(dirPath + "/metadata")
+	if model == "" || err != nil {
+		model = filepath.Base(filepath.Clean(dirPath))
+	}
+	return dir, model, nil
+}
+
 // ShowAll prints the content of all gob files in a directory to the console.
 // It does not need the corresponding struct to decode the gob files.
+// The passphrase is read from the GORIALIZE_PASS environment variable.
 func ShowAll(dirPath string) error {
+	return ShowAllWith(dirPath, nil)
+}
+
+// ShowAllWith is like ShowAll but takes the key from the key provider, which
+// defaults to the GORIALIZE_PASS environment variable.
+func ShowAllWith(dirPath string, keys KeyProvider) error {
 	files, err := ioutil.ReadDir(dirPath)
 	if err != nil {
 		return err
 	}
 
-	passphrase := os.Getenv("GORIALIZE_PASS")
-	dir := NewDirectory(DirectoryConfig{
-		Encrypted:  passphrase != "",
-		Passphrase: passphrase,
-		Log:        false,
-	})
+	dir, model, err := openShowDirectory(dirPath, keys)
+	if err != nil {
+		return err
+	}
 
 	for _, f := range files {
 		if f.IsDir() {
@@ -80,6 +135,7 @@ func ShowAll(dirPath string) error {
 			continue
 		}
 		q := dir.newQueryWithID("show", nil, id)
+		q.Model = model
 		q.DirPath = dirPath
 		q.ThwartIOBasePathEscape()
 		q.ExitIfDirNotExist()
@@ -87,8 +143,8 @@ func ShowAll(dirPath string) error {
 		q.ReadGobFromDisk()
 		q.DecryptGobBuffer()
 		if q.FatalError != nil {
-			if q.FatalError.Error()[:6] == "cipher" {
-				fmt.Println("Failed to decrypt with GORIALIZE_PASS environment variable.")
+			if errors.Is(q.FatalError, ErrDecrypt) {
+				fmt.Println(decryptFailedText)
 			}
 			return q.FatalError
 		}
@@ -96,7 +152,7 @@ func ShowAll(dirPath string) error {
 		dec := degob.NewDecoder(reader)
 		gobs, err := dec.Decode()
 		if err != nil {
-			fmt.Println("Failed to decode gob. If directory is encrypted set GORIALIZE_PASS environment variable.")
+			fmt.Println(decodeFailedText)
 			return err
 		}
 		for _, g := range gobs {
@@ -108,3 +164,135 @@ func ShowAll(dirPath string) error {
 	}
 	return nil
 }
+
+// Reindex rebuilds the index of every model inside a directory.
+// It does not need the corresponding structs but relies on the schemas
+// recorded in each model's metadata directory. The passphrase is read from
+// the GORIALIZE_PASS environment variable.
+func Reindex(dirPath string) error {
+	return ReindexWith(dirPath, nil)
+}
+
+// ReindexWith is like Reindex but takes the key from the key provider, which
+// defaults to the GORIALIZE_PASS environment variable.
+func ReindexWith(dirPath string, keys KeyProvider) error {
+	dir, err := OpenDirectory(DirectoryConfig{
+		Path:        dirPath,
+		KeyProvider: cliKeyProvider(keys, "GORIALIZE_PASS"),
+		Log:         false,
+	})
+	if err != nil {
+		if errors.Is(err, ErrDecrypt) {
+			fmt.Println(decryptFailedText)
+		}
+		return err
+	}
+
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	models := map[string]reflect.Type{}
+	for _, f := range files {
+		if !f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		model, resourceType, err := dir.readSchema(dirPath + "/" + f.Name() + "/metadata")
+		if os.IsNotExist(err) {
+			fmt.Println("Skipping", f.Name(), "since it has no schema.")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if model == "" {
+			model = f.Name()
+		}
+		models[model] = resourceType
+	}
+
+	counts, err := dir.rebuildIndex(models)
+	if err != nil {
+		if errors.Is(err, ErrDecrypt) {
+			fmt.Println(decryptFailedText)
+		}
+		return err
+	}
+	names := []string{}
+	for model := range models {
+		names = append(names, model)
+	}
+	sort.Strings(names)
+	for _, model := range names {
+		fmt.Printf("%s: %d resources indexed\n", model, counts[model])
+	}
+	return nil
+}
+
+// Rekey re-encrypts a directory with the key of newKeys, which defaults to
+// the GORIALIZE_NEW_PASS environment variable. keys defaults to the
+// GORIALIZE_PASS environment variable. The directory is encrypted if there is
+// no current key. It is only decrypted if decrypt is set, which fails if
+// there is a new key, and Rekey fails without a new key otherwise. An
+// interrupted rekey is resumed by running it again with the new key as the
+// current one.
+func Rekey(dirPath string, keys KeyProvider, newKeys KeyProvider, decrypt bool) error {
+	newKeys = cliKeyProvider(newKeys, "GORIALIZE_NEW_PASS")
+	if decrypt && newKeys != nil {
+		return errors.New("New key given with --decrypt")
+	}
+	if !decrypt && newKeys == nil {
+		return errors.New("New key missing, pass --new-key-file, --new-key-cmd or set GORIALIZE_NEW_PASS environment variable, or --decrypt to decrypt the directory")
+	}
+	dir, err := OpenDirectory(DirectoryConfig{
+		Path:        dirPath,
+		KeyProvider: cliKeyProvider(keys, "GORIALIZE_PASS"),
+		Log:         false,
+	})
+	if err != nil {
+		if errors.Is(err, ErrDecrypt) {
+			fmt.Println(decryptFailedText)
+		}
+		return err
+	}
+
+	err = dir.RekeyWith(newKeys, func(p RekeyProgress) {
+		fmt.Printf("\r%d/%d resources rekeyed", p.Done, p.Total)
+		if p.Done == p.Total {
+			fmt.Println()
+		}
+	})
+	if err != nil {
+		if errors.Is(err, ErrDecrypt) {
+			fmt.Println()
+			fmt.Println(decryptFailedText)
+		}
+		return err
+	}
+	fmt.Println("Directory rekeyed.")
+	return nil
+}
+
+// PruneKeys drops the previous keys kept by rekey once every process has
+// reopened the directory. The key provider defaults to the GORIALIZE_PASS
+// environment variable.
+func PruneKeys(dirPath string, keys KeyProvider) error {
+	dir, err := OpenDirectory(DirectoryConfig{
+		Path:        dirPath,
+		KeyProvider: cliKeyProvider(keys, "GORIALIZE_PASS"),
+		Log:         false,
+	})
+	if err != nil {
+		if errors.Is(err, ErrDecrypt) {
+			fmt.Println(decryptFailedText)
+		}
+		return err
+	}
+
+	err = dir.PruneKeys()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Previous keys pruned.")
+	return nil
+}
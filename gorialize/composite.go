@@ -0,0 +1,143 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// compositeFieldPrefix marks the field part of a composite index's keys, e.g.
+// "model:&tenant_status:value", so that it can't collide with a struct field.
+const compositeFieldPrefix = "&"
+
+// compositeIndex is an index over several fields of a resource type declared
+// by tagging each of them `gorialize:"index:name"`. Its fields are kept in
+// the order they are declared in the struct.
+type compositeIndex struct {
+	name   string
+	fields []string
+}
+
+// field returns the field part of the composite index's keys.
+func (c compositeIndex) field() string {
+	return compositeFieldPrefix + c.name
+}
+
+func isCompositeField(field string) bool {
+	return strings.HasPrefix(field, compositeFieldPrefix)
+}
+
+// compositeIndexes returns the composite indexes of a resource type sorted by
+// name.
+func compositeIndexes(resourceType reflect.Type) (composites []compositeIndex) {
+	byName := map[string]*compositeIndex{}
+	names := []string{}
+	for i := 0; i < resourceType.Elem().NumField(); i++ {
+		field := resourceType.Elem().Field(i)
+		for _, name := range parseFieldTag(field).composites {
+			if byName[name] == nil {
+				byName[name] = &compositeIndex{name: name}
+				names = append(names, name)
+			}
+			byName[name].fields = append(byName[name].fields, field.Name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		composites = append(composites, *byName[name])
+	}
+	return
+}
+
+// compositeValue converts query values to the types of a composite index's
+// fields and joins their index key representations, lower cased for lowered
+// fields as in their own index, into the value part of the composite index's
+// key.
+func compositeValue(resourceType reflect.Type, composite compositeIndex, values []interface{}) (string, error) {
+	encoded := make([]string, len(values))
+	for i, value := range values {
+		fp, err := lookupField(resourceType, composite.fields[i])
+		if err == nil {
+			encoded[i], err = fp.encodeValue(value)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(encoded, ","), nil
+}
+
+// compositeResourceValue joins the index key representations of a resource's
+// values of a composite index's fields like compositeValue.
+func compositeResourceValue(resourceType reflect.Type, composite compositeIndex, resource interface{}) string {
+	values := []string{}
+	for _, field := range composite.fields {
+		fp, _ := lookupField(resourceType, field)
+		values = append(values, fp.indexValue(reflect.Indirect(reflect.ValueOf(resource)).FieldByName(field)))
+	}
+	return strings.Join(values, ",")
+}
+
+// isEquality reports whether a clause only compares its field with Equals.
+func (clause Where) isEquality() bool {
+	return clause.Field != "" && clause.Filter == nil && clause.Match == "" && !clause.isStringMatch() && !clause.isRange() && len(clause.In) == 0 && len(clause.Range) == 0
+}
+
+// useCompositeIndexes replaces the Equals clauses of a chain of ANDed clauses
+// covering all fields of a composite index by a single clause on that index.
+// Composite indexes covering more fields are preferred. A composite index is
+// skipped if a value can't be converted to its field's type, so that the
+// error is reported by the lookup of the single field.
+func useCompositeIndexes(resourceType reflect.Type, links []Where) []Where {
+	composites := compositeIndexes(resourceType)
+	for {
+		best := -1
+		for i, composite := range composites {
+			if (best < 0 || len(composite.fields) > len(composites[best].fields)) && coversComposite(links, composite) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return links
+		}
+
+		composite := composites[best]
+		used := map[int]bool{}
+		values := []interface{}{}
+		for _, field := range composite.fields {
+			for i, link := range links {
+				if !used[i] && link.isEquality() && link.Field == field {
+					used[i] = true
+					values = append(values, link.Equals)
+					break
+				}
+			}
+		}
+		value, err := compositeValue(resourceType, composite, values)
+		if err != nil {
+			composites = append(composites[:best], composites[best+1:]...)
+			continue
+		}
+		remaining := []Where{{Field: composite.field(), Equals: value}}
+		for i, link := range links {
+			if !used[i] {
+				remaining = append(remaining, link)
+			}
+		}
+		links = remaining
+	}
+}
+
+func coversComposite(links []Where, composite compositeIndex) bool {
+	for _, field := range composite.fields {
+		covered := false
+		for _, link := range links {
+			covered = covered || link.isEquality() && link.Field == field
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
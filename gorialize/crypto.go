@@ -2,12 +2,677 @@
 package gorialize
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Key derivation functions of encrypted directories, see DirectoryConfig.KDF.
+const (
+	KDFScrypt   = "scrypt"
+	KDFArgon2id = "argon2id"
 )
 
+// keyParamsVersion is the version of the key parameters file format.
+const keyParamsVersion = 1
+
+// keyParams are the salt and work factors the key of an encrypted directory
+// is derived with. They are stored as JSON in the directory's .keyparams file
+// when the directory is first opened with encryption. Migrating is set until
+// the resources of a directory encrypted with the legacy unsalted key have
+// been re-encrypted.
+type keyParams struct {
+	Version   int    `json:"version"`
+	KDF       string `json:"kdf"`
+	Salt      []byte `json:"salt"`
+	N         int    `json:"n,omitempty"`
+	R         int    `json:"r,omitempty"`
+	P         int    `json:"p,omitempty"`
+	Time      uint32 `json:"time,omitempty"`
+	Memory    uint32 `json:"memory,omitempty"`
+	Threads   uint8  `json:"threads,omitempty"`
+	Migrating bool   `json:"migrating,omitempty"`
+	// Check is a keyed hash telling whether a passphrase derives the
+	// directory's key. Sealed is set once the index log, counters, schemas
+	// and journal are encrypted as well as the resources. ObfuscateModels
+	// names model directories by a keyed hash of the model name.
+	Check           []byte `json:"check,omitempty"`
+	Sealed          bool   `json:"sealed,omitempty"`
+	ObfuscateModels bool   `json:"obfuscateModels,omitempty"`
+	// KeyID identifies the key in the headers of the resources it encrypted.
+	// While the directory is rekeyed, Rekeying is set. Keyring holds the
+	// previous keys wrapped with the current key until they are pruned, so
+	// that resources which haven't been re-encrypted yet, or which processes
+	// still using a previous key wrote, can still be read. ModelKey is the
+	// wrapped key of obfuscated model names once the directory was rekeyed.
+	KeyID    uint32       `json:"keyID,omitempty"`
+	Keyring  []wrappedKey `json:"keyring,omitempty"`
+	ModelKey []byte       `json:"modelKey,omitempty"`
+	Rekeying string       `json:"rekeying,omitempty"`
+	// Bound is set once resources written without the resource header have
+	// been re-encrypted with it, binding them to their model and ID.
+	Bound bool `json:"bound,omitempty"`
+}
+
+// wrappedKey is a previous key of a directory encrypted with its current key.
+type wrappedKey struct {
+	ID  uint32 `json:"id"`
+	Key []byte `json:"key"`
+}
+
+// wrapKey encrypts a key with the directory's current key.
+func wrapKey(current *[32]byte, key []byte) ([]byte, error) {
+	return encrypt(current, key, []byte("gorialize keyring"))
+}
+
+func unwrapKey(current *[32]byte, wrapped []byte) ([]byte, error) {
+	return decrypt(current, wrapped, []byte("gorialize keyring"))
+}
+
+// oldKeys returns the previous keys of the keyring by ID.
+func (params keyParams) oldKeys(current *[32]byte) (map[uint32]*[32]byte, error) {
+	keys := map[uint32]*[32]byte{}
+	for _, wrapped := range params.Keyring {
+		b, err := unwrapKey(current, wrapped.Key)
+		if err != nil {
+			return nil, err
+		}
+		var key [32]byte
+		copy(key[:], b)
+		keys[wrapped.ID] = &key
+	}
+	return keys, nil
+}
+
+// modelKey returns the key model directory names are hashed with. It is
+// derived from the directory's first key and kept wrapped once the directory
+// was rekeyed.
+func (params keyParams) modelKey(current *[32]byte) ([]byte, error) {
+	if len(params.ModelKey) > 0 {
+		return unwrapKey(current, params.ModelKey)
+	}
+	h := hmac.New(sha256.New, current[:])
+	h.Write([]byte("gorialize model names"))
+	return h.Sum(nil), nil
+}
+
+// newKeyParams returns the parameters of a new directory with a random salt
+// and the recommended work factors of the key derivation function.
+func newKeyParams(kdf string) (*keyParams, error) {
+	params := &keyParams{Version: keyParamsVersion, KDF: kdf, Salt: make([]byte, 16)}
+	switch kdf {
+	case "", KDFScrypt:
+		params.KDF = KDFScrypt
+		params.N, params.R, params.P = 1<<15, 8, 1
+	case KDFArgon2id:
+		params.Time, params.Memory, params.Threads = 1, 64*1024, 4
+	case kdfRaw:
+		params.Salt = nil
+		return params, nil
+	default:
+		return nil, fmt.Errorf("Unknown key derivation function %s", kdf)
+	}
+	_, err := io.ReadFull(rand.Reader, params.Salt)
+	return params, err
+}
+
+// deriveKey derives the directory's encryption key from a passphrase.
+func (params keyParams) deriveKey(passphrase string) (*[32]byte, error) {
+	var b []byte
+	var err error
+	switch params.KDF {
+	case KDFScrypt:
+		b, err = scrypt.Key([]byte(passphrase), params.Salt, params.N, params.R, params.P, 32)
+	case KDFArgon2id:
+		if params.Time == 0 || params.Memory == 0 || params.Threads == 0 {
+			return nil, errors.New("Invalid argon2id parameters")
+		}
+		b = argon2.IDKey([]byte(passphrase), params.Salt, params.Time, params.Memory, params.Threads, 32)
+	case kdfRaw:
+		return nil, errors.New("Directory key isn't derived from a passphrase and must be supplied by a key provider")
+	default:
+		return nil, fmt.Errorf("Unknown key derivation function %s", params.KDF)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], b)
+	return &key, nil
+}
+
+func keyParamsPath(basePath string) string {
+	return basePath + "/.keyparams"
+}
+
+// readKeyParams reads the key parameters of the directory at basePath.
+func readKeyParams(basePath string) (*keyParams, error) {
+	b, err := readFromDisk(keyParamsPath(basePath))
+	if err != nil {
+		return nil, err
+	}
+	params := &keyParams{}
+	err = json.Unmarshal(b, params)
+	if err != nil {
+		return nil, errors.New("Key parameters are corrupt: " + err.Error())
+	}
+	if params.Version != keyParamsVersion {
+		return nil, fmt.Errorf("Unsupported key parameters version %d", params.Version)
+	}
+	return params, nil
+}
+
+func writeKeyParams(basePath string, params *keyParams) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return writeToDisk(keyParamsPath(basePath), b)
+}
+
+// hashPassphrase derives the key of directories created before keys were
+// derived with a salt. It is only used to migrate them.
 func hashPassphrase(passphrase []byte) []byte {
 	h := hmac.New(sha512.New512_256, []byte("key"))
 	_, _ = h.Write(passphrase) // TODO find out if returned err should be checked
 	return h.Sum(nil)
 }
+
+func legacyKey(passphrase string) *[32]byte {
+	var key [32]byte
+	copy(key[:], hashPassphrase([]byte(passphrase)))
+	return &key
+}
+
+// readKey derives the key of the directory at basePath and reads its keyring
+// without writing anything, falling back to the legacy key if the directory
+// has no key parameters yet.
+func (dir *Directory) readKey(basePath string, material KeyMaterial) error {
+	dir.Encrypted = true
+	params, err := readKeyParams(basePath)
+	if os.IsNotExist(err) {
+		dir.Key = material.legacyKey()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dir.Key, err = material.deriveKey(*params)
+	if err != nil {
+		return err
+	}
+	if len(params.Check) > 0 && !hmac.Equal(params.Check, keyCheck(dir.Key)) {
+		return ErrDecrypt
+	}
+	dir.keyID = params.KeyID
+	dir.oldKeys, err = params.oldKeys(dir.Key)
+	dir.converting = params.Rekeying == rekeyEncrypt || params.Rekeying == rekeyDecrypt
+	dir.sealed = params.Sealed && !params.Migrating
+	return err
+}
+
+// keyCheck returns the value recorded in the key parameters to tell a wrong
+// passphrase from a corrupt directory.
+func keyCheck(key *[32]byte) []byte {
+	h := hmac.New(sha256.New, key[:])
+	h.Write([]byte("gorialize key check"))
+	return h.Sum(nil)
+}
+
+// openKey derives the directory's key from the passphrase or takes the raw
+// key of the key material. A directory without key parameters gets new ones
+// with a random salt. A directory which already holds resources encrypted
+// with the legacy key is marked as migrating, see migrateKey, once the
+// passphrase decrypts one of them. It fails with ErrDecrypt if the
+// passphrase doesn't or if the parameters' key check doesn't match.
+func (dir *Directory) openKey(material KeyMaterial, kdf string, obfuscateModels bool) error {
+	err := os.MkdirAll(dir.Path, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	l, err := lockFile(keyParamsPath(dir.Path)+".lock", true, true)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	params, err := readKeyParams(dir.Path)
+	created := os.IsNotExist(err)
+	var paths map[string][]string
+	if created {
+		if material.Key != nil {
+			kdf = kdfRaw
+		}
+		params, err = newKeyParams(kdf)
+		if err == nil {
+			paths, err = dir.resourcePaths()
+		}
+		for _, modelPaths := range paths {
+			params.Migrating = params.Migrating || len(modelPaths) > 0
+		}
+	}
+	if err != nil {
+		return err
+	}
+	dir.Key, err = material.deriveKey(*params)
+	if err != nil {
+		return err
+	}
+	if created {
+		if params.Migrating {
+			// Nothing is written unless the passphrase decrypts the
+			// resources, e.g. if a plaintext directory was opened with
+			// encryption by mistake.
+			err = dir.checkKey(paths, true, material.legacyKey())
+		} else {
+			params.Check = keyCheck(dir.Key)
+			params.Sealed = true
+			params.Bound = true
+			params.ObfuscateModels = obfuscateModels
+		}
+		if err == nil {
+			err = writeKeyParams(dir.Path, params)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(params.Check) > 0 && !hmac.Equal(params.Check, keyCheck(dir.Key)) {
+		return ErrDecrypt
+	}
+	dir.keyID = params.KeyID
+	dir.oldKeys, err = params.oldKeys(dir.Key)
+	if err != nil {
+		return err
+	}
+	dir.converting = params.Rekeying == rekeyEncrypt || params.Rekeying == rekeyDecrypt
+	dir.sealed = params.Sealed && !params.Migrating
+	if params.ObfuscateModels {
+		dir.modelKey, err = params.modelKey(dir.Key)
+	}
+	return err
+}
+
+// migrateKey completes directories written before their key was derived
+// with a salt or before their metadata was encrypted: resources encrypted
+// with the legacy key are re-encrypted with the directory's key and
+// plaintext counters, schemas and index log lines are encrypted. Resources
+// without the resource header are re-encrypted with it, so that they can't
+// be swapped or moved anymore. The passphrase is checked against a resource
+// first, so that a wrong one doesn't change anything. Resources with the
+// header the directory's keys decrypt were migrated before an interruption
+// and are skipped, so an interrupted migration is resumed the next time the
+// directory is opened.
+func (dir Directory) migrateKey(material KeyMaterial) error {
+	l, err := lockFile(keyParamsPath(dir.Path)+".lock", true, true)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	params, err := readKeyParams(dir.Path)
+	if err != nil {
+		return err
+	}
+	if len(params.Check) > 0 && params.Sealed && params.Bound && !params.Migrating {
+		return nil
+	}
+	paths, err := dir.resourcePaths()
+	if err != nil {
+		return err
+	}
+	legacy := material.legacyKey()
+	if len(params.Check) == 0 {
+		err = dir.checkKey(paths, params.Migrating, legacy)
+		if err != nil {
+			return err
+		}
+	}
+	for model, modelPaths := range paths {
+		err := dir.migrateModel(model, modelPaths, params.Migrating, !params.Bound, legacy)
+		if err != nil {
+			return err
+		}
+	}
+	// Compacts plaintext index log lines before they are rejected.
+	err = dir.ReplayIndexLog()
+	if err != nil {
+		return err
+	}
+	params.Check = keyCheck(dir.Key)
+	params.Sealed = true
+	params.Bound = true
+	params.Migrating = false
+	return writeKeyParams(dir.Path, params)
+}
+
+// checkKey fails with ErrDecrypt if the first resource can be decrypted
+// neither with the directory's key nor, while migrating, with the legacy key.
+func (dir Directory) checkKey(paths map[string][]string, migrating bool, legacy *[32]byte) error {
+	for model, modelPaths := range paths {
+		for _, path := range modelPaths {
+			b, err := readFromDisk(path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			id, _ := strconv.Atoi(filepath.Base(path))
+			_, err = dir.openResource(model, id, b)
+			if err != nil && migrating {
+				_, err = decrypt(legacy, b, nil)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// resourcePaths returns the paths of the serialized resources of every model
+// directory grouped by the directory's name. Model directories without
+// resources are included with no paths.
+func (dir Directory) resourcePaths() (map[string][]string, error) {
+	models, err := ioutil.ReadDir(dir.Path)
+	if err != nil {
+		return nil, err
+	}
+	paths := map[string][]string{}
+	for _, model := range models {
+		if !model.IsDir() || strings.HasPrefix(model.Name(), ".") {
+			continue
+		}
+		files, err := ioutil.ReadDir(dir.Path + "/" + model.Name())
+		if err != nil {
+			return nil, err
+		}
+		paths[model.Name()] = []string{}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			if _, err := strconv.Atoi(f.Name()); err != nil {
+				continue
+			}
+			paths[model.Name()] = append(paths[model.Name()], filepath.Join(dir.Path, model.Name(), f.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// migrateModel re-encrypts the resources of a model directory encrypted with
+// the legacy key if migrating, and those without the resource header if
+// binding, and encrypts its plaintext counter and schema.
+func (dir Directory) migrateModel(model string, paths []string, migrating bool, binding bool, legacy *[32]byte) error {
+	defer dir.lockModel(model, true)()
+	metadataPath := dir.Path + "/" + model + "/metadata"
+	err := os.MkdirAll(metadataPath, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	l, err := lockFile(metadataPath+"/lock", true, true)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	for _, path := range paths {
+		if !migrating && !binding {
+			break
+		}
+		b, err := readFromDisk(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		id, _ := strconv.Atoi(filepath.Base(path))
+		header, _ := parseResourceHeader(b)
+		plaintext, err := dir.openResource(model, id, b)
+		if err == nil && header != nil {
+			continue
+		}
+		if err != nil && migrating {
+			plaintext, err = decrypt(legacy, b, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		b, err = sealResource(dir.Key, dir.keyID, model, id, plaintext)
+		if err != nil {
+			return err
+		}
+		err = writeToDisk(path, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, path := range []string{metadataPath + "/counter", metadataPath + "/schema"} {
+		b, err := readFromDisk(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := decrypt(dir.Key, b, nil); err == nil {
+			continue
+		}
+		b, err = encrypt(dir.Key, b, nil)
+		if err != nil {
+			return err
+		}
+		err = writeToDisk(path, b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// plaintextAllowed tells whether plaintext index log lines, counters, schemas
+// and journals are accepted in an encrypted directory, which they are until
+// its metadata is sealed and while Rekey encrypts or decrypts it.
+func (dir Directory) plaintextAllowed() bool {
+	return !dir.sealed || dir.converting
+}
+
+// seal encrypts b with the directory's key if the directory is encrypted.
+func (dir Directory) seal(b []byte) ([]byte, error) {
+	if !dir.Encrypted {
+		return b, nil
+	}
+	if dir.Key == nil {
+		return nil, errors.New("Encryption key missing")
+	}
+	return encrypt(dir.Key, b, nil)
+}
+
+// unseal decrypts b if the directory is encrypted. It fails with ErrDecrypt
+// if b wasn't sealed with any of the directory's keys.
+func (dir Directory) unseal(b []byte) ([]byte, error) {
+	if !dir.Encrypted {
+		return b, nil
+	}
+	if dir.Key == nil {
+		return nil, errors.New("Decryption key missing")
+	}
+	plaintext, err := decrypt(dir.Key, b, nil)
+	for _, key := range dir.oldKeys {
+		if err == nil {
+			break
+		}
+		plaintext, err = decrypt(key, b, nil)
+	}
+	return plaintext, err
+}
+
+// modelDirName returns the name of a model's directory, which is a keyed hash
+// of the model name if the directory obfuscates model names.
+func (dir Directory) modelDirName(model string) string {
+	if dir.modelKey == nil {
+		return model
+	}
+	h := hmac.New(sha256.New, dir.modelKey)
+	h.Write([]byte(model))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// resourceMagic starts encrypted resources whose ciphertext is bound to their
+// model and ID. It is followed by the format version. Version 1 resources
+// were encrypted with the key of ID 0, version 2 resources are followed by
+// the 4 byte ID of their key. Resources without it were encrypted without
+// associated data with the key of ID 0 and are read as before.
+const resourceMagic = "gzr"
+
+const resourceFormat = 2
+
+// resourceHeader returns the header of resources encrypted with the key of
+// the given ID.
+func resourceHeader(keyID uint32) []byte {
+	header := append([]byte(resourceMagic), resourceFormat, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[len(resourceMagic)+1:], keyID)
+	return header
+}
+
+// parseResourceHeader returns the header of an encrypted resource and the ID
+// of its key. header is nil if the resource has no header of a known version.
+func parseResourceHeader(b []byte) (header []byte, keyID uint32) {
+	n := len(resourceMagic)
+	if len(b) <= n || !bytes.HasPrefix(b, []byte(resourceMagic)) {
+		return nil, 0
+	}
+	switch {
+	case b[n] == 1:
+		return b[:n+1], 0
+	case b[n] == resourceFormat && len(b) >= n+5:
+		return b[:n+5], binary.BigEndian.Uint32(b[n+1 : n+5])
+	}
+	return nil, 0
+}
+
+// resourceData returns the associated data binding a resource's ciphertext to
+// its header, model and ID.
+func resourceData(header []byte, model string, id int) []byte {
+	return []byte(string(header) + model + "\x00" + strconv.Itoa(id))
+}
+
+// sealResource encrypts a resource's gob with the key of the given ID and its
+// model and ID as associated data and prepends the resource header.
+func sealResource(key *[32]byte, keyID uint32, model string, id int, plaintext []byte) ([]byte, error) {
+	header := resourceHeader(keyID)
+	ciphertext, err := encrypt(key, plaintext, resourceData(header, model, id))
+	if err != nil {
+		return nil, err
+	}
+	return append(header, ciphertext...), nil
+}
+
+// openResource decrypts a resource sealed by sealResource with any of the
+// directory's keys or, without the resource header, by versions which didn't
+// bind resources to their model and ID. It fails with ErrTampered if the
+// resource was sealed for another model or ID, e.g. because the file was
+// swapped or moved.
+func (dir Directory) openResource(model string, id int, b []byte) ([]byte, error) {
+	header, keyID := parseResourceHeader(b)
+	key := dir.keyByID(keyID)
+	if header != nil && key != nil {
+		plaintext, err := decrypt(key, b[len(header):], resourceData(header, model, id))
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+	// Resources without header and legacy ciphertexts whose random nonce
+	// happens to start like the header.
+	var plaintext []byte
+	err := ErrDecrypt
+	if legacy := dir.keyByID(0); legacy != nil {
+		plaintext, err = decrypt(legacy, b, nil)
+	}
+	switch {
+	case err == nil || !bytes.HasPrefix(b, []byte(resourceMagic)):
+		return plaintext, err
+	case header == nil:
+		return nil, fmt.Errorf("Unsupported resource format %d", b[len(resourceMagic)])
+	case key == nil:
+		return nil, fmt.Errorf("%w: unknown key ID %d", ErrDecrypt, keyID)
+	}
+	return nil, ErrTampered
+}
+
+// isPlaintextResource tells whether a resource openResource failed to open
+// is in plaintext because Rekey is encrypting or decrypting the directory.
+// Only resources without the resource header which no key decrypts are, so
+// that tampered resources are still rejected.
+func (dir Directory) isPlaintextResource(b []byte, err error) bool {
+	return dir.converting && errors.Is(err, ErrDecrypt) && !errors.Is(err, ErrTampered) &&
+		!bytes.HasPrefix(b, []byte(resourceMagic))
+}
+
+// keyByID returns the directory's key of the given ID, which is either the
+// current key or one of its previous keys until they are pruned.
+func (dir Directory) keyByID(id uint32) *[32]byte {
+	if id == dir.keyID {
+		return dir.Key
+	}
+	return dir.oldKeys[id]
+}
+
+// encrypt seals plaintext with AES-256-GCM and prepends the random nonce.
+func encrypt(key *[32]byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// decrypt opens ciphertext sealed by encrypt with the same additional data.
+// It fails with ErrDecrypt if the key is wrong or the ciphertext was modified.
+func decrypt(key *[32]byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+func newGCM(key *[32]byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
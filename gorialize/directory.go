@@ -2,16 +2,15 @@
 package gorialize
 
 import (
-	"bufio"
+	"errors"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
-	"sync"
+	"time"
 )
 
-var mutex sync.Mutex
-
 // Directory exposes methods to read and write serialized data inside a base directory.
 type Directory struct {
 	Path         string
@@ -20,6 +19,24 @@ type Directory struct {
 	Log          bool
 	Index        Index
 	IndexLogPath string
+	writerLock   *fileLock
+	indexLog     *indexLogState
+	// slowQueryThreshold and slowQueryCallback report the plans of queries
+	// taking at least the threshold.
+	slowQueryThreshold time.Duration
+	slowQueryCallback  func(plan Plan)
+	// modelKey is the key model directory names are hashed with if the
+	// directory obfuscates model names.
+	modelKey []byte
+	// keyID is the ID of Key. oldKeys are the previous keys by ID until they
+	// are pruned after the directory was rekeyed. converting is set while an
+	// interrupted Rekey encrypts or decrypts the directory, whose resources
+	// can then be in plaintext. sealed is set once the index log, counters,
+	// schemas and journal are encrypted, whose plaintext is rejected then.
+	keyID      uint32
+	oldKeys    map[uint32]*[32]byte
+	converting bool
+	sealed     bool
 }
 
 // DirectoryConfig holds parameters to be passed to NewDirectory().
@@ -27,78 +44,183 @@ type DirectoryConfig struct {
 	Path       string
 	Encrypted  bool
 	Passphrase string
-	Log        bool
+	// KeyProvider supplies the key or passphrase of an encrypted directory
+	// instead of Passphrase, e.g. KeyFile, EnvPassphrase or
+	// CommandPassphrase. Setting it implies Encrypted.
+	KeyProvider KeyProvider
+	// KDF is the key derivation function, KDFScrypt or KDFArgon2id, used
+	// when an encrypted directory is opened for the first time. It defaults
+	// to KDFScrypt. Existing directories keep the function and the random
+	// salt recorded in their .keyparams file.
+	KDF string
+	// ObfuscateModelNames names the model directories of a new encrypted
+	// directory by a keyed hash of the model name instead of the model name.
+	ObfuscateModelNames bool
+	Log                 bool
+	// SingleWriter makes OpenDirectory fail with ErrDirectoryLocked if another
+	// single writer already holds the directory. Call Close to release it.
+	// The lock is advisory: directories opened without SingleWriter ignore it
+	// and can still write.
+	SingleWriter bool
+	// CompactIndexAfterBytes and CompactIndexAfterLines trigger CompactIndex
+	// once the index log exceeds the given size or number of entries.
+	// Zero disables the respective threshold.
+	CompactIndexAfterBytes int64
+	CompactIndexAfterLines int
+	// SlowQueryThreshold makes Find, FindCB, ReadAll, ReadAllCB, Count and the
+	// aggregate queries taking at least as long pass their plan to
+	// SlowQueryCallback. Zero disables reporting.
+	SlowQueryThreshold time.Duration
+	SlowQueryCallback  func(plan Plan)
 }
 
 // NewDirectory returns a new Directory struct for the given configuration.
+// It exits the program if the directory can't be opened. Use OpenDirectory
+// to handle such errors instead.
 func NewDirectory(config DirectoryConfig) *Directory {
+	dir, err := OpenDirectory(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return dir
+}
+
+// OpenDirectory returns a new Directory struct for the given configuration.
+// It derives the encryption key from the passphrase or asks the key provider
+// for it, removes leftovers of
+// interrupted writes and replays the index log. Encrypted directories created
+// before keys were derived with a random salt or before their metadata was
+// encrypted are migrated on first open.
+func OpenDirectory(config DirectoryConfig) (*Directory, error) {
 	dir := &Directory{
-		Path:         config.Path,
-		Log:          config.Log,
-		Index:        NewIndex(),
-		IndexLogPath: config.Path + "/.idxlog",
+		Path:               config.Path,
+		Log:                config.Log,
+		Index:              NewIndex(),
+		IndexLogPath:       config.Path + "/.idxlog",
+		slowQueryThreshold: config.SlowQueryThreshold,
+		slowQueryCallback:  config.SlowQueryCallback,
+		indexLog: &indexLogState{
+			compactAfterBytes: config.CompactIndexAfterBytes,
+			compactAfterLines: config.CompactIndexAfterLines,
+		},
 	}
 
+	material := KeyMaterial{Passphrase: config.Passphrase}
+	if config.KeyProvider != nil {
+		var err error
+		material, err = config.KeyProvider.ProvideKey()
+		if err != nil {
+			return nil, err
+		}
+		config.Encrypted = true
+	}
 	if config.Encrypted {
-		var key [32]byte
-		h := hashPassphrase([]byte(config.Passphrase))
-		copy(key[:], h[:32])
-		dir.Key = &key
+		dir.Key = material.legacyKey()
 		dir.Encrypted = true
 	}
 
-	dir.ReplayIndexLog()
-	return dir
+	if config.SingleWriter {
+		err := os.MkdirAll(dir.Path, os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+		dir.writerLock, err = lockFile(dir.Path+"/.lock", true, false)
+		if err == errWouldBlock {
+			return nil, ErrDirectoryLocked
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ObfuscateModelNames && !config.Encrypted {
+		dir.Close()
+		return nil, errors.New("Model names can only be obfuscated in encrypted directories")
+	}
+	if dir.Path != "" && dir.Encrypted {
+		if err := dir.openKey(material, config.KDF, config.ObfuscateModelNames); err != nil {
+			dir.Close()
+			return nil, err
+		}
+	}
+	if dir.Path != "" {
+		if err := dir.removeTempFiles(); err != nil {
+			dir.Close()
+			return nil, err
+		}
+	}
+	if dir.Path != "" {
+		if err := dir.recoverJournal(); err != nil {
+			dir.Close()
+			return nil, err
+		}
+	}
+	if dir.Path != "" && dir.Encrypted {
+		if err := dir.migrateKey(material); err != nil {
+			dir.Close()
+			return nil, err
+		}
+		dir.sealed = true
+	}
+	if err := dir.ReplayIndexLog(); err != nil {
+		dir.Close()
+		return nil, err
+	}
+	return dir, nil
+}
+
+// Close releases the single writer lock if the directory was opened with
+// DirectoryConfig.SingleWriter. It is a no-op otherwise.
+func (dir *Directory) Close() error {
+	err := dir.writerLock.unlock()
+	dir.writerLock = nil
+	return err
 }
 
-func (dir Directory) ReplayIndexLog() {
-	f, err := os.Open(dir.IndexLogPath)
+// removeTempFiles removes temporary files left behind by interrupted writes.
+// Each directory's files are removed while holding the file lock its writers
+// use, so that in-flight writes of other processes are left alone.
+func (dir Directory) removeTempFiles() error {
+	tmpFiles, err := findTempFiles(dir.Path)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return
-		}
-		log.Fatal(err)
+		return err
 	}
-	defer f.Close()
+	for dirPath, paths := range tmpFiles {
+		var lockPath string
+		switch {
+		case filepath.Clean(dirPath) == filepath.Clean(dir.Path):
+			lockPath = dir.IndexLogPath + ".lock"
+		case filepath.Base(dirPath) == "metadata":
+			lockPath = dirPath + "/lock"
+		default:
+			lockPath = dirPath + "/metadata/lock"
+			if _, err := os.Stat(dirPath + "/metadata"); os.IsNotExist(err) {
+				lockPath = ""
+			}
+		}
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) < 4 {
-			log.Fatalf("IndexLog contains unprocessable line: %s", line)
+		var l *fileLock
+		if lockPath != "" {
+			l, err = lockFile(lockPath, true, true)
+			if err != nil {
+				return err
+			}
 		}
-		var id []byte
-		var key string
-		for i := len(line) - 1; i >= 0; i-- {
-			if line[i] == '=' || line[i] == ':' {
-				key = line[1:i]
+		for _, path := range paths {
+			err = os.Remove(path)
+			if err != nil && !os.IsNotExist(err) {
 				break
-			} else {
-				id = append([]byte{line[i]}, id...)
 			}
+			err = nil
 		}
-		ID, err := strconv.Atoi(string(id))
-		if err != nil {
-			log.Fatalf("IndexLog contains unprocessable line: %s", line)
+		if unlockErr := l.unlock(); err == nil {
+			err = unlockErr
 		}
-		op := line[0]
-		switch op {
-		case '+':
-			err := dir.Index.addDirectly(key, ID)
-			if err != nil {
-				log.Fatalf("IndexLog contains unprocessable line: %s", line)
-			}
-		case '-':
-			val := line[1:]
-			dir.Index.removeDirectly(val, ID)
-		default:
-			log.Fatalf("IndexLog contains unprocessable line: %s", line)
+		if err != nil {
+			return err
 		}
 	}
-
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
-	}
+	return nil
 }
 
 func (dir Directory) newQueryWithoutID(operation string, resource interface{}) *Query {
@@ -120,8 +242,7 @@ func (dir Directory) newQueryWithID(operation string, resource interface{}, id i
 
 // Create creates a new serialized resource and sets its ID.
 func (dir Directory) Create(resource interface{}) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+	defer dir.lockModel(modelOf(resource), true)()
 
 	q := dir.newQueryWithoutID("create", resource)
 	q.ReflectTypeOfResource()
@@ -130,6 +251,9 @@ func (dir Directory) Create(resource interface{}) error {
 	q.ThwartIOBasePathEscape()
 	q.BuildMetadataPath()
 	q.CreateMetadataDirectoryIfNotExist()
+	q.LockFile()
+	q.WriteSchema()
+	q.ExitIfUniqueViolation()
 	q.BuildCounterPath()
 	q.ReadCounterFromDisk()
 	q.IncrementCounterAndSetID()
@@ -139,14 +263,14 @@ func (dir Directory) Create(resource interface{}) error {
 	q.WriteGobToDisk()
 	q.WriteCounterToDisk()
 	q.UpdateIndex('+')
+	q.UnlockFile()
 	q.Log()
-	return q.FatalError
+	return q.Err()
 }
 
 // Read reads the serialized resource with the given ID.
 func (dir Directory) Read(resource interface{}, id int) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+	defer dir.lockModel(modelOf(resource), false)()
 
 	q := dir.newQueryWithID("read", resource, id)
 	q.ReflectTypeOfResource()
@@ -159,7 +283,7 @@ func (dir Directory) Read(resource interface{}, id int) error {
 	q.DecryptGobBuffer()
 	q.DecodeGobToResource()
 	q.Log()
-	return q.FatalError
+	return q.Err()
 }
 
 // GetOwner reads the serialized resource which owns the given resource.
@@ -178,10 +302,10 @@ func (dir Directory) GetOwner(resource interface{}, owner interface{}) error {
 // readFromCustomSubdirectory reads the serialized resource with the given ID from a custom subdirectory.
 // This method is intended for testing purposes.
 func (dir Directory) readFromCustomSubdirectory(resource interface{}, id int, subdir string) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+	defer dir.lockModel(subdir, false)()
 
 	q := dir.newQueryWithID("read", resource, id)
+	q.Model = subdir
 	q.BuildCustomDirPath(subdir)
 	q.ThwartIOBasePathEscape()
 	q.ExitIfDirNotExist()
@@ -190,11 +314,12 @@ func (dir Directory) readFromCustomSubdirectory(resource interface{}, id int, su
 	q.DecryptGobBuffer()
 	q.DecodeGobToResource()
 	q.Log()
-	return q.FatalError
+	return q.Err()
 }
 
 // ReadAll reads all serialized resources of the given slice's element type and appends them to the slice.
-func (dir Directory) ReadAll(slice interface{}) error {
+// The results can be sorted and paginated with the OrderBy, Limit, Offset and After query options.
+func (dir Directory) ReadAll(slice interface{}, options ...QueryOption) error {
 	slicePtr := reflect.ValueOf(slice)
 	sliceVal := reflect.Indirect(slicePtr)
 	resourceTyp := reflect.TypeOf(slice).Elem().Elem()
@@ -205,31 +330,37 @@ func (dir Directory) ReadAll(slice interface{}) error {
 		resourcePtr := reflect.ValueOf(resource)
 		resourceVal := reflect.Indirect(resourcePtr)
 		sliceVal.Set(reflect.Append(sliceVal, resourceVal))
-	})
+	}, options...)
 	return err
 }
 
 // ReadAllCB reads all serialized resources of the given type and calls the provided callback function on each.
-func (dir Directory) ReadAllCB(resource interface{}, callback func(resource interface{})) error {
-	mutex.Lock()
-	defer mutex.Unlock()
-	var err error
+func (dir Directory) ReadAllCB(resource interface{}, callback func(resource interface{}), options ...QueryOption) error {
+	return dir.readAllCB(resource, callback, options, nil)
+}
+
+func (dir Directory) readAllCB(resource interface{}, callback func(resource interface{}), options []QueryOption, plan *Plan) error {
+	defer dir.lockModel(modelOf(resource), false)()
 
 	q := dir.newQueryWithoutID("read all", resource)
+	q.StartPlan(plan)
+	defer q.FinishPlan()
+	q.ApplyOptions(options)
+	q.ExitIfWhereClauses()
 	q.ReflectTypeOfResource()
 	q.ReflectModelNameFromType()
 	q.BuildDirPath()
 	q.ThwartIOBasePathEscape()
 	q.ExitIfDirNotExist()
 	q.ReadDirFileinfo()
-	for _, f := range q.DirFileInfo {
-		if f.IsDir() {
-			continue
-		}
-		q.ID, err = strconv.Atoi(f.Name())
-		if err != nil {
-			continue
-		}
+	q.MatchIDsFromDirFileinfo()
+	q.ApplyFilters()
+	q.RefreshIndexForOrder()
+	q.SortMatchedIDs()
+	q.ApplyCursor()
+	q.PaginateMatchedIDs()
+	for _, id := range q.MatchedIDs {
+		q.ID = id
 		q.BuildResourcePath()
 		q.ReadGobFromDisk()
 		q.DecryptGobBuffer()
@@ -237,12 +368,13 @@ func (dir Directory) ReadAllCB(resource interface{}, callback func(resource inte
 		q.PassResourceToCallback(callback)
 		q.Log()
 	}
-	return q.FatalError
+	return q.Err()
 }
 
 // Find finds all serialized resource of the given slice's element
 // type matching all provided WHERE clauses and appends them to the slice.
-func (dir Directory) Find(slice interface{}, clauses ...Where) error {
+// The results can be sorted and paginated with the OrderBy, Limit, Offset and After query options.
+func (dir Directory) Find(slice interface{}, options ...QueryOption) error {
 	slicePtr := reflect.ValueOf(slice)
 	sliceVal := reflect.Indirect(slicePtr)
 	resourceTyp := reflect.TypeOf(slice).Elem().Elem()
@@ -253,24 +385,33 @@ func (dir Directory) Find(slice interface{}, clauses ...Where) error {
 		resourcePtr := reflect.ValueOf(resource)
 		resourceVal := reflect.Indirect(resourcePtr)
 		sliceVal.Set(reflect.Append(sliceVal, resourceVal))
-	}, clauses...)
+	}, options...)
 	return err
 }
 
 // FindCB finds all serialized resource of the given type matching all
 // provided WHERE clauses and calls the provided callback function on each.
-func (dir Directory) FindCB(resource interface{}, callback func(resource interface{}), clauses ...Where) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+func (dir Directory) FindCB(resource interface{}, callback func(resource interface{}), options ...QueryOption) error {
+	return dir.findCB(resource, callback, options, nil)
+}
+
+func (dir Directory) findCB(resource interface{}, callback func(resource interface{}), options []QueryOption, plan *Plan) error {
+	defer dir.lockModel(modelOf(resource), false)()
 
 	q := dir.newQueryWithoutID("find all", resource)
-	q.WhereClauses = clauses
+	q.StartPlan(plan)
+	defer q.FinishPlan()
+	q.ApplyOptions(options)
 	q.ReflectTypeOfResource()
 	q.ReflectModelNameFromType()
+	q.RefreshIndex()
 	q.ApplyWhereClauses()
 	q.BuildDirPath()
 	q.ThwartIOBasePathEscape()
 	q.ExitIfDirNotExist()
+	q.SortMatchedIDs()
+	q.ApplyCursor()
+	q.PaginateMatchedIDs()
 	for _, id := range q.MatchedIDs {
 		q.ID = id
 		q.BuildResourcePath()
@@ -280,17 +421,16 @@ func (dir Directory) FindCB(resource interface{}, callback func(resource interfa
 		q.PassResourceToCallback(callback)
 		q.Log()
 	}
-	return q.FatalError
+	return q.Err()
 }
 
 // Replace replaces a serialized resource.
 func (dir Directory) Replace(resource interface{}) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+	defer dir.lockModel(modelOf(resource), true)()
 
 	id, err := getID(resource)
 	if err != nil {
-		return err
+		return &QueryError{Op: "replace", Err: err}
 	}
 	q := dir.newQueryWithID("replace", resource, id)
 	q.ReflectTypeOfResource()
@@ -298,25 +438,29 @@ func (dir Directory) Replace(resource interface{}) error {
 	q.BuildDirPath()
 	q.ThwartIOBasePathEscape()
 	q.ExitIfDirNotExist()
+	q.BuildMetadataPath()
+	q.CreateMetadataDirectoryIfNotExist()
+	q.LockFile()
 	q.BuildResourcePath()
 	q.ExitIfResourceNotExist()
+	q.ExitIfUniqueViolation()
 	q.EncodeResourceToGob()
 	q.EncryptGobBuffer()
 	q.BuildResourcePath()
 	q.WriteGobToDisk()
 	q.UpdateIndex('x')
+	q.UnlockFile()
 	q.Log()
-	return q.FatalError
+	return q.Err()
 }
 
 // Delete deletes a serialized resource.
 func (dir Directory) Delete(resource interface{}) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+	defer dir.lockModel(modelOf(resource), true)()
 
 	id, err := getID(resource)
 	if err != nil {
-		return err
+		return &QueryError{Op: "delete", Err: err}
 	}
 	q := dir.newQueryWithID("delete", resource, id)
 	q.ReflectTypeOfResource()
@@ -324,18 +468,21 @@ func (dir Directory) Delete(resource interface{}) error {
 	q.BuildDirPath()
 	q.ThwartIOBasePathEscape()
 	q.ExitIfDirNotExist()
+	q.BuildMetadataPath()
+	q.CreateMetadataDirectoryIfNotExist()
+	q.LockFile()
 	q.BuildResourcePath()
 	q.ThwartIOBasePathEscape()
 	q.DeleteFromDisk()
 	q.UpdateIndex('-')
+	q.UnlockFile()
 	q.Log()
-	return q.FatalError
+	return q.Err()
 }
 
 // DeleteAll deletes all serialized resources of the given type.
 func (dir Directory) DeleteAll(resource interface{}) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+	defer dir.lockModel(modelOf(resource), true)()
 	var err error
 
 	q := dir.newQueryWithoutID("delete all", resource)
@@ -344,6 +491,9 @@ func (dir Directory) DeleteAll(resource interface{}) error {
 	q.BuildDirPath()
 	q.ThwartIOBasePathEscape()
 	q.ExitIfDirNotExist()
+	q.BuildMetadataPath()
+	q.CreateMetadataDirectoryIfNotExist()
+	q.LockFile()
 	q.ReadDirFileinfo()
 	for _, f := range q.DirFileInfo {
 		if f.IsDir() {
@@ -358,13 +508,13 @@ func (dir Directory) DeleteAll(resource interface{}) error {
 		q.UpdateIndex('-')
 		q.Log()
 	}
-	return q.FatalError
+	q.UnlockFile()
+	return q.Err()
 }
 
 // ResetCounter resets the resource counter to zero
 func (dir Directory) ResetCounter(resource interface{}) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+	defer dir.lockModel(modelOf(resource), true)()
 
 	q := dir.newQueryWithoutID("reset counter", resource)
 	q.ReflectTypeOfResource()
@@ -373,9 +523,11 @@ func (dir Directory) ResetCounter(resource interface{}) error {
 	q.ThwartIOBasePathEscape()
 	q.BuildMetadataPath()
 	q.CreateMetadataDirectoryIfNotExist()
+	q.LockFile()
 	q.BuildCounterPath()
 	q.SetCounterToZero()
 	q.WriteCounterToDisk()
+	q.UnlockFile()
 	q.Log()
-	return q.FatalError
+	return q.Err()
 }
@@ -0,0 +1,82 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors returned by Directory methods, usually wrapped in a *QueryError.
+// Use errors.Is to test for them.
+var (
+	ErrNotFound        = errors.New("resource not found")
+	ErrModelDirMissing = errors.New("model directory does not exist")
+	ErrDecrypt         = errors.New("failed to decrypt resource")
+	ErrNoIDField       = errors.New("resource does not have an addressable ID int field")
+	ErrNoMatches       = errors.New("no resources match the where clauses")
+	ErrDirectoryLocked = errors.New("directory is held by another writer")
+	ErrTxDone          = errors.New("transaction has already been committed or rolled back")
+	// ErrTampered is returned when an encrypted resource was sealed for another
+	// model or ID, e.g. because its file was swapped or moved. It wraps
+	// ErrDecrypt.
+	ErrTampered = fmt.Errorf("%w: resource was sealed for another model or ID", ErrDecrypt)
+)
+
+// QueryError records the operation, model and resource ID of a failed query
+// together with the error which caused it.
+type QueryError struct {
+	Op    string
+	Model string
+	ID    int
+	Err   error
+}
+
+func (e *QueryError) Error() string {
+	if e.ID > 0 {
+		return fmt.Sprintf("gorialize: %s %s %d: %v", e.Op, e.Model, e.ID, e.Err)
+	}
+	if e.Model != "" {
+		return fmt.Sprintf("gorialize: %s %s: %v", e.Op, e.Model, e.Err)
+	}
+	return fmt.Sprintf("gorialize: %s: %v", e.Op, e.Err)
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// ErrCorruptIndexLog is returned when the index log contains a line which
+// cannot be replayed.
+type ErrCorruptIndexLog struct {
+	Path string
+	Line int
+	Text string
+}
+
+func (e *ErrCorruptIndexLog) Error() string {
+	return fmt.Sprintf("gorialize: corrupt index log %s at line %d: %q", e.Path, e.Line, e.Text)
+}
+
+// ErrPathEscape is returned when a query would read or write outside of the
+// directory's base path.
+type ErrPathEscape struct {
+	Path     string
+	BasePath string
+}
+
+func (e *ErrPathEscape) Error() string {
+	return fmt.Sprintf("gorialize: thwarted IO operation on %s outside of %s", e.Path, e.BasePath)
+}
+
+// ErrUniqueViolation is returned when a write would store a value of a field
+// tagged `gorialize:"indexed,unique"` which another resource already has.
+type ErrUniqueViolation struct {
+	Model string
+	Field string
+	Value interface{}
+	ID    int
+}
+
+func (e *ErrUniqueViolation) Error() string {
+	return fmt.Sprintf("gorialize: unique field %s.%s value %v already used by resource %d", e.Model, e.Field, e.Value, e.ID)
+}
@@ -0,0 +1,317 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+// Expr is a boolean expression of where clauses built with And, Or and Not.
+// Where clauses are expressions themselves. Expressions are passed to Find()
+// and FindCB() and ORed with the query's other where clauses and expressions.
+type Expr interface {
+	QueryOption
+	matches(model string, resource interface{}) bool
+}
+
+type andExpr []Expr
+
+type orExpr []Expr
+
+type notExpr struct {
+	expr Expr
+}
+
+// And matches resources matching all of the expressions.
+func And(exprs ...Expr) Expr {
+	return andExpr(exprs)
+}
+
+// Or matches resources matching any of the expressions.
+func Or(exprs ...Expr) Expr {
+	return orExpr(exprs)
+}
+
+// Not matches resources not matching the expression.
+func Not(expr Expr) Expr {
+	return notExpr{expr: expr}
+}
+
+func (e andExpr) applyTo(q *Query) {
+	q.Exprs = append(q.Exprs, e)
+}
+
+func (e orExpr) applyTo(q *Query) {
+	q.Exprs = append(q.Exprs, e)
+}
+
+func (e notExpr) applyTo(q *Query) {
+	q.Exprs = append(q.Exprs, e)
+}
+
+func (clause Where) matches(model string, resource interface{}) bool {
+	return matchesWhere(model, resource, clause)
+}
+
+func (e andExpr) matches(model string, resource interface{}) bool {
+	for _, expr := range e {
+		if !expr.matches(model, resource) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e orExpr) matches(model string, resource interface{}) bool {
+	for _, expr := range e {
+		if expr.matches(model, resource) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e notExpr) matches(model string, resource interface{}) bool {
+	return !e.expr.matches(model, resource)
+}
+
+// idSet is a set of resource IDs.
+type idSet map[int]bool
+
+func newIDSet(ids []int) idSet {
+	s := make(idSet, len(ids))
+	for _, id := range ids {
+		s[id] = true
+	}
+	return s
+}
+
+func (s idSet) intersect(other idSet) idSet {
+	result := idSet{}
+	for id := range s {
+		if other[id] {
+			result[id] = true
+		}
+	}
+	return result
+}
+
+func (s idSet) union(other idSet) idSet {
+	result := make(idSet, len(s)+len(other))
+	for id := range s {
+		result[id] = true
+	}
+	for id := range other {
+		result[id] = true
+	}
+	return result
+}
+
+func (s idSet) subtract(other idSet) idSet {
+	result := idSet{}
+	for id := range s {
+		if !other[id] {
+			result[id] = true
+		}
+	}
+	return result
+}
+
+func (s idSet) ids() []int {
+	ids := make([]int, 0, len(s))
+	for id := range s {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// expr returns the query's where clauses and expressions ORed into a single
+// expression.
+func (q *Query) expr() Expr {
+	exprs := orExpr{}
+	for _, clause := range q.WhereClauses {
+		exprs = append(exprs, clause)
+	}
+	return append(exprs, q.Exprs...)
+}
+
+// exprLeaves calls leaf with every where clause of the expressions and
+// whether it is negated.
+func exprLeaves(exprs []Expr, negated bool, leaf func(clause Where, negated bool)) {
+	for _, expr := range exprs {
+		switch e := expr.(type) {
+		case Where:
+			leaf(e, negated)
+		case andExpr:
+			exprLeaves(e, negated, leaf)
+		case orExpr:
+			exprLeaves(e, negated, leaf)
+		case notExpr:
+			exprLeaves([]Expr{e.expr}, !negated, leaf)
+		}
+	}
+}
+
+// universeIDs returns the IDs of all resources of the query's model, read
+// from the directory listing once per query.
+func (q *Query) universeIDs() (idSet, error) {
+	if q.universe == nil {
+		ids, err := q.allIDs()
+		if err != nil {
+			return nil, err
+		}
+		q.universe = newIDSet(ids)
+	}
+	return q.universe, nil
+}
+
+// exprIDs returns the IDs of the resources matching the expression using set
+// operations over the index. ok is false if the expression can't be answered
+// without decoding every resource of the model, e.g. a clause on a field which
+// isn't indexed outside of an And narrowed down by an indexed clause. Not is
+// answered by subtracting from the other operands of an enclosing And or else
+// from all IDs in the directory listing.
+func (q *Query) exprIDs(expr Expr) (ids idSet, ok bool, err error) {
+	switch e := expr.(type) {
+	case Where:
+		indexed, residual := q.planChain(e)
+		if indexed == nil {
+			return nil, false, nil
+		}
+		matched, err := q.Dir.Index.getMatchingIDs(q.Model, q.ResourceType, *indexed)
+		step := ClausePlan{
+			Clause:    e.describe(),
+			Indexes:   indexNames(q.ResourceType, indexed),
+			Estimated: len(matched),
+		}
+		if err == nil && len(residual) > 0 {
+			step.Scan = describeWheres(residual)
+			matched, err = q.filterIDs(matched, residual)
+		}
+		step.Actual = len(matched)
+		q.plan.addClause(step)
+		return newIDSet(matched), err == nil, err
+	case orExpr:
+		ids = idSet{}
+		for _, operand := range e {
+			operandIDs, ok, err := q.exprIDs(operand)
+			if err != nil || !ok {
+				return nil, false, err
+			}
+			ids = ids.union(operandIDs)
+		}
+		return ids, true, nil
+	case notExpr:
+		negated, ok, err := q.exprIDs(e.expr)
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		universe, err := q.universeIDs()
+		if err != nil {
+			return nil, false, err
+		}
+		ids = universe.subtract(negated)
+		q.plan.addClause(ClausePlan{
+			Clause:    describeExpr(e),
+			Indexes:   []string{"listing"},
+			Estimated: len(universe),
+			Actual:    len(ids),
+		})
+		return ids, true, nil
+	case andExpr:
+		negated := idSet{}
+		residual := []Expr{}
+		for _, operand := range e {
+			if not, isNot := operand.(notExpr); isNot {
+				notIDs, ok, err := q.exprIDs(not.expr)
+				if err != nil {
+					return nil, false, err
+				}
+				if ok {
+					negated = negated.union(notIDs)
+					continue
+				}
+			} else {
+				operandIDs, ok, err := q.exprIDs(operand)
+				if err != nil {
+					return nil, false, err
+				}
+				if ok {
+					if ids == nil {
+						ids = operandIDs
+					} else {
+						ids = ids.intersect(operandIDs)
+					}
+					continue
+				}
+			}
+			residual = append(residual, operand)
+		}
+		if ids == nil {
+			if len(residual) > 0 {
+				return nil, false, nil
+			}
+			ids, err = q.universeIDs()
+			if err != nil {
+				return nil, false, err
+			}
+		}
+		ids = ids.subtract(negated)
+		if len(residual) > 0 {
+			step := ClausePlan{
+				Clause:    describeExpr(e),
+				Scan:      describeExpr(andExpr(residual)),
+				Estimated: len(ids),
+			}
+			ids, err = q.filterExpr(ids.ids(), And(residual...))
+			step.Actual = len(ids)
+			q.plan.addClause(step)
+		}
+		return ids, err == nil, err
+	}
+	return nil, false, nil
+}
+
+// filterExpr decodes the resources with the given IDs and returns the IDs of
+// those matching the expression.
+func (q *Query) filterExpr(ids []int, expr Expr) (idSet, error) {
+	matched, err := q.filterIDs(ids, []Where{{Filter: func(resource interface{}) bool {
+		return expr.matches(q.Model, resource)
+	}}})
+	return newIDSet(matched), err
+}
+
+// applyExprs matches the IDs of the resources matching the query's where
+// clauses and expressions and all of its filters, scanning all resources of
+// the model if the index can't narrow them down.
+func (q *Query) applyExprs() {
+	expr := q.expr()
+	ids, ok, err := q.exprIDs(expr)
+	if err == nil && !ok {
+		var universe idSet
+		universe, err = q.universeIDs()
+		if err == nil {
+			ids, err = q.filterExpr(universe.ids(), expr)
+			q.plan.addClause(ClausePlan{
+				Clause:    describeExpr(expr),
+				Scan:      describeExpr(expr),
+				FullScan:  true,
+				Estimated: len(universe),
+				Actual:    len(ids),
+			})
+		}
+	}
+	if err != nil {
+		q.FatalError = err
+		return
+	}
+	q.MatchedIDs = ids.ids()
+	q.ApplyFilters()
+}
+
+// rankedClauses returns the query's where clauses and the clauses of its
+// expressions which aren't negated, i.e. those contributing to relevance.
+func (q *Query) rankedClauses() []Where {
+	clauses := append([]Where{}, q.WhereClauses...)
+	exprLeaves(q.Exprs, false, func(clause Where, negated bool) {
+		if !negated {
+			clauses = append(clauses, clause)
+		}
+	})
+	return clauses
+}
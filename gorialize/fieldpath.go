@@ -0,0 +1,220 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// fieldPath locates a possibly nested field of a resource type by a dotted
+// path such as "Address.City". Fields of embedded structs are promoted, so
+// the canonical name of a field omits the names of embedded structs. The
+// field has several values if the path passes through slices, arrays or maps:
+// each element of a slice or array is a value and so is each key of a map.
+type fieldPath struct {
+	name  string
+	steps [][]int
+	typ   reflect.Type
+	multi bool
+	tag   fieldTag
+}
+
+// lookupField returns the path of the field with the given dotted name.
+func lookupField(resourceType reflect.Type, name string) (fp fieldPath, err error) {
+	if resourceType == nil {
+		return fp, fmt.Errorf("Resource type missing")
+	}
+	t := resourceType.Elem()
+	names := []string{}
+	for _, segment := range strings.Split(name, ".") {
+		t = fp.containedType(t)
+		if t.Kind() != reflect.Struct || t == timeType {
+			return fp, fmt.Errorf("Field %s does not exist", name)
+		}
+		f, ok := t.FieldByName(segment)
+		if !ok || f.PkgPath != "" {
+			return fp, fmt.Errorf("Field %s does not exist", name)
+		}
+		fp.steps = append(fp.steps, f.Index)
+		for i := range f.Index {
+			if sf := t.FieldByIndex(f.Index[:i+1]); !sf.Anonymous {
+				names = append(names, sf.Name)
+			}
+		}
+		fp.tag = parseFieldTag(f)
+		t = f.Type
+	}
+	fp.name = strings.Join(names, ".")
+	fp.typ = fp.leafType(t)
+	return fp, nil
+}
+
+// indexedFields returns the paths of all fields of a resource type tagged as
+// indexed or fulltext, including those of nested and embedded structs.
+func indexedFields(resourceType reflect.Type) (fields []fieldPath) {
+	var collect func(t reflect.Type, parent fieldPath, names []string, visited map[reflect.Type]bool)
+	collect = func(t reflect.Type, parent fieldPath, names []string, visited map[reflect.Type]bool) {
+		visited[t] = true
+		defer delete(visited, t)
+
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" && !f.Anonymous {
+				continue
+			}
+			fp := parent
+			fp.steps = append(append([][]int{}, parent.steps...), []int{i})
+			fieldNames := names
+			if !f.Anonymous {
+				fieldNames = append(append([]string{}, names...), f.Name)
+			}
+			fp.tag = parseFieldTag(f)
+			if fp.tag.indexed || fp.tag.fulltext {
+				leaf := fp
+				leaf.name = strings.Join(fieldNames, ".")
+				leaf.typ = leaf.leafType(f.Type)
+				fields = append(fields, leaf)
+			}
+			nested := fp.containedType(f.Type)
+			if nested.Kind() == reflect.Struct && nested != timeType && !visited[nested] {
+				collect(nested, fp, fieldNames, visited)
+			}
+		}
+	}
+	collect(resourceType.Elem(), fieldPath{}, nil, map[reflect.Type]bool{})
+	return
+}
+
+// containedType returns the type of the values reached through pointers,
+// slices, arrays and map values of type t and records whether there are
+// several of them.
+func (fp *fieldPath) containedType(t reflect.Type) reflect.Type {
+	for {
+		switch t.Kind() {
+		case reflect.Ptr:
+			t = t.Elem()
+		case reflect.Slice, reflect.Array, reflect.Map:
+			fp.multi = true
+			t = t.Elem()
+		default:
+			return t
+		}
+	}
+}
+
+// leafType returns the type of an indexed field's values: the element type
+// of slices and arrays and the key type of maps.
+func (fp *fieldPath) leafType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		fp.multi = true
+		t = t.Elem()
+	case reflect.Map:
+		fp.multi = true
+		t = t.Key()
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// values returns the values of the field in a resource's struct value.
+// Nil pointers along the path have no values.
+func (fp fieldPath) values(val reflect.Value) []reflect.Value {
+	values := []reflect.Value{val}
+	for _, step := range fp.steps {
+		next := []reflect.Value{}
+		for _, v := range values {
+			for _, v := range expandValue(v) {
+				if f, ok := fieldByIndex(v, step); ok {
+					next = append(next, f)
+				}
+			}
+		}
+		values = next
+	}
+
+	leaves := []reflect.Value{}
+	for _, v := range values {
+		v, ok := indirectValue(v)
+		if !ok {
+			continue
+		}
+		switch v.Kind() {
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < v.Len(); i++ {
+				if elem, ok := indirectValue(v.Index(i)); ok {
+					leaves = append(leaves, elem)
+				}
+			}
+		case reflect.Map:
+			keys := v.MapKeys()
+			sort.Slice(keys, func(i, j int) bool {
+				return formatIndexValue(keys[i]) < formatIndexValue(keys[j])
+			})
+			for _, key := range keys {
+				if key, ok := indirectValue(key); ok {
+					leaves = append(leaves, key)
+				}
+			}
+		default:
+			leaves = append(leaves, v)
+		}
+	}
+	return leaves
+}
+
+// expandValue dereferences pointers and returns the elements of slices and
+// arrays and the values of maps.
+func expandValue(v reflect.Value) []reflect.Value {
+	v, ok := indirectValue(v)
+	if !ok {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		values := []reflect.Value{}
+		for i := 0; i < v.Len(); i++ {
+			values = append(values, expandValue(v.Index(i))...)
+		}
+		return values
+	case reflect.Map:
+		values := []reflect.Value{}
+		iter := v.MapRange()
+		for iter.Next() {
+			values = append(values, expandValue(iter.Value())...)
+		}
+		return values
+	}
+	return []reflect.Value{v}
+}
+
+func indirectValue(v reflect.Value) (reflect.Value, bool) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return v, false
+		}
+		v = v.Elem()
+	}
+	return v, v.IsValid()
+}
+
+// fieldByIndex is reflect.Value.FieldByIndex without panicking on nil
+// embedded struct pointers.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for _, i := range index {
+		var ok bool
+		v, ok = indirectValue(v)
+		if !ok || v.Kind() != reflect.Struct {
+			return v, false
+		}
+		v = v.Field(i)
+	}
+	return v, true
+}
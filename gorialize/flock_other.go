@@ -0,0 +1,28 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import "os"
+
+// fileLock is a no-op on platforms without flock(2). Only the in-process
+// locks protect the directory there.
+type fileLock struct {
+	f *os.File
+}
+
+func lockFile(path string, exclusive bool, wait bool) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileLock{f: f}, nil
+}
+
+func (l *fileLock) unlock() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
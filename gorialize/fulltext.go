@@ -0,0 +1,260 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// relevanceField is the order of queries with Match clauses and no OrderBy.
+// Results are sorted by descending TF-IDF score, ties by ID.
+const relevanceField = "~relevance"
+
+// fulltextField returns the pseudo-field holding the inverted index of a
+// field tagged as fulltext. Its values are a token and the number of times
+// the token occurs in the field, e.g. "model:~Notes:gob,2".
+func fulltextField(field string) string {
+	return "~" + field
+}
+
+// isFulltextField reports whether a resource type's field is tagged as
+// fulltext.
+func isFulltextField(resourceType reflect.Type, field string) bool {
+	fp, err := lookupField(resourceType, field)
+	return err == nil && fp.tag.fulltext
+}
+
+// tokenize splits a text into lower case words of letters and digits.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// textTokens returns how many times each token occurs in the string values.
+func textTokens(values []reflect.Value) map[string]int {
+	tokens := map[string]int{}
+	for _, value := range values {
+		if value.Kind() != reflect.String {
+			continue
+		}
+		for _, token := range tokenize(value.String()) {
+			tokens[token]++
+		}
+	}
+	return tokens
+}
+
+// fulltextLogEntries returns the index log entries adding the tokens of a
+// resource's fulltext field.
+func fulltextLogEntries(model string, field string, values []reflect.Value, id int) (logEntries []string) {
+	tokens := textTokens(values)
+	sorted := make([]string, 0, len(tokens))
+	for token := range tokens {
+		sorted = append(sorted, token)
+	}
+	sort.Strings(sorted)
+	for _, token := range sorted {
+		value := escapeIndexValue(token) + "," + strconv.Itoa(tokens[token])
+		logEntries = append(logEntries, fmt.Sprintf("+%s=%d", makeKey(model, fulltextField(field), value), id))
+	}
+	return
+}
+
+// matchTerm is a term of a Match query. Prefix terms, written with a
+// trailing '*', match every token starting with the term.
+type matchTerm struct {
+	token  string
+	prefix bool
+}
+
+func (term matchTerm) matches(token string) bool {
+	if term.prefix {
+		return strings.HasPrefix(token, term.token)
+	}
+	return token == term.token
+}
+
+// parseMatch parses a Match query into ORed groups of ANDed terms. Terms are
+// ANDed unless separated by OR, which binds weaker than AND.
+func parseMatch(query string) (groups [][]matchTerm, err error) {
+	group := []matchTerm{}
+	for _, word := range strings.Fields(query) {
+		switch word {
+		case "OR":
+			if len(group) > 0 {
+				groups = append(groups, group)
+			}
+			group = []matchTerm{}
+			continue
+		case "AND":
+			continue
+		}
+		tokens := tokenize(word)
+		for i, token := range tokens {
+			group = append(group, matchTerm{
+				token:  token,
+				prefix: i == len(tokens)-1 && strings.HasSuffix(word, "*"),
+			})
+		}
+	}
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	if len(groups) == 0 {
+		return nil, errors.New("Match query without terms")
+	}
+	return groups, nil
+}
+
+// matchesText reports whether the tokens of a text match a Match query.
+func matchesText(groups [][]matchTerm, tokens map[string]int) bool {
+	for _, group := range groups {
+		matched := true
+		for _, term := range group {
+			found := false
+			for token := range tokens {
+				if term.matches(token) {
+					found = true
+					break
+				}
+			}
+			matched = matched && found
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchScores returns the TF-IDF scores of the resources matching a Match
+// query on a fulltext field. A group's score is the sum of its terms' scores
+// and a resource matching several groups gets the highest. The caller must
+// hold the index's read lock.
+func (idx Index) matchScores(model string, resourceType reflect.Type, field string, query string) (map[int]float64, error) {
+	fp, err := lookupField(resourceType, field)
+	if err != nil {
+		return nil, err
+	}
+	if !fp.tag.fulltext {
+		return nil, fmt.Errorf("Field %s is not tagged as fulltext", field)
+	}
+	groups, err := parseMatch(query)
+	if err != nil {
+		return nil, err
+	}
+	si, err := idx.sortedIndexFor(model, fulltextField(fp.name), orderString)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := map[int]bool{}
+	for _, e := range si.entries {
+		docs[e.id] = true
+	}
+	scores := map[int]float64{}
+	for _, group := range groups {
+		var groupScores map[int]float64
+		for i, term := range group {
+			postings := si.postings(term)
+			idf := math.Log(1 + float64(len(docs))/float64(len(postings)))
+			next := map[int]float64{}
+			for id, tf := range postings {
+				if score, ok := groupScores[id]; ok || i == 0 {
+					next[id] = score + float64(tf)*idf
+				}
+			}
+			groupScores = next
+		}
+		for id, score := range groupScores {
+			if best, ok := scores[id]; !ok || score > best {
+				scores[id] = score
+			}
+		}
+	}
+	return scores, nil
+}
+
+// postings returns how many times the tokens matching a term occur in each
+// resource. The sorted index must be the one of a fulltext field.
+func (si *sortedIndex) postings(term matchTerm) map[int]int {
+	prefix := term.token
+	if !term.prefix {
+		prefix += ","
+	}
+	postings := map[int]int{}
+	i := sort.Search(len(si.entries), func(i int) bool {
+		return si.entries[i].value.s >= prefix
+	})
+	for ; i < len(si.entries) && strings.HasPrefix(si.entries[i].value.s, prefix); i++ {
+		s := si.entries[i].value.s
+		tf, err := strconv.Atoi(s[strings.LastIndex(s, ",")+1:])
+		if err != nil {
+			continue
+		}
+		postings[si.entries[i].id] += tf
+	}
+	return postings
+}
+
+// hasMatch reports whether any of the clauses or the clauses ANDed to them
+// has a Match query.
+func hasMatch(clauses []Where) bool {
+	for _, clause := range clauses {
+		for c := &clause; c != nil; c = c.And {
+			if c.Match != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// relevance returns the sum of the TF-IDF scores of the Match clauses on
+// fulltext fields for each matching resource.
+func (idx Index) relevance(model string, resourceType reflect.Type, clauses []Where) (map[int]float64, error) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	relevance := map[int]float64{}
+	for _, clause := range clauses {
+		for c := &clause; c != nil; c = c.And {
+			if c.Match == "" || !isFulltextField(resourceType, c.Field) {
+				continue
+			}
+			scores, err := idx.matchScores(model, resourceType, c.Field, c.Match)
+			if err != nil {
+				return nil, err
+			}
+			for id, score := range scores {
+				relevance[id] += score
+			}
+		}
+	}
+	return relevance, nil
+}
+
+// sortByRelevance sorts the matched IDs by descending relevance. Scores are
+// negated so that ties are broken by ascending ID.
+func (q *Query) sortByRelevance() {
+	relevance, err := q.Dir.Index.relevance(q.Model, q.ResourceType, q.rankedClauses())
+	if err != nil {
+		q.FatalError = err
+		return
+	}
+	si := &sortedIndex{kind: orderFloat}
+	for _, id := range q.MatchedIDs {
+		si.entries = append(si.entries, sortedEntry{value: orderedValue{f: -relevance[id]}, id: id})
+	}
+	sort.Slice(si.entries, func(i, j int) bool {
+		return si.less(si.entries[i], si.entries[j])
+	})
+	q.sorted = si.entries
+}
@@ -1,8 +1,21 @@
 package gorialize
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"syreclabs.com/go/faker"
 )
@@ -38,6 +51,85 @@ type todoItem struct {
 	Text       string
 }
 
+type event struct {
+	ID        int
+	Title     string    `gorialize:"indexed"`
+	Score     float64   `gorialize:"indexed"`
+	CreatedAt time.Time `gorialize:"indexed"`
+}
+
+type ticket struct {
+	ID       int
+	TenantID int    `gorialize:"index:tenant_status"`
+	Status   string `gorialize:"indexed,index:tenant_status"`
+	Title    string
+}
+
+// cents prints differently from the int it is indexed as.
+type cents int
+
+func (c cents) String() string {
+	return fmt.Sprintf("$%d.%02d", c/100, c%100)
+}
+
+type product struct {
+	ID    int
+	Name  string `gorialize:"indexed"`
+	Price cents  `gorialize:"indexed"`
+}
+
+type account struct {
+	ID    int
+	Email string `gorialize:"indexed,unique"`
+	Name  string
+}
+
+type address struct {
+	Street string
+	City   string `gorialize:"indexed"`
+}
+
+type Audit struct {
+	CreatedBy string `gorialize:"indexed"`
+}
+
+type member struct {
+	ID     int
+	Name   string `gorialize:"indexed"`
+	Email  string `gorialize:"indexed,unique,lower"`
+	Handle string
+	Age    int
+}
+
+type tenantMember struct {
+	ID       int
+	TenantID int    `gorialize:"index:tenant_email"`
+	Email    string `gorialize:"indexed,lower,index:tenant_email"`
+}
+
+type subscriber struct {
+	ID     int
+	Status string `gorialize:"indexed"`
+	Banned bool   `gorialize:"indexed"`
+	Plan   string
+}
+
+type note struct {
+	ID     int
+	Title  string `gorialize:"fulltext"`
+	Body   string `gorialize:"fulltext"`
+	Author string
+}
+
+type customer struct {
+	ID int
+	Audit
+	Tags    []string `gorialize:"indexed"`
+	Address address
+	Offices []*address
+	Scores  map[string]int `gorialize:"indexed"`
+}
+
 var dir *Directory
 
 func beforeEach() {
@@ -53,6 +145,15 @@ func beforeEach() {
 	_ = dir.DeleteAll(&userV3{})
 	_ = dir.DeleteAll(&todoList{})
 	_ = dir.DeleteAll(&todoItem{})
+	_ = dir.DeleteAll(&event{})
+	_ = dir.DeleteAll(&account{})
+	_ = dir.DeleteAll(&ticket{})
+	_ = dir.DeleteAll(&product{})
+	_ = dir.DeleteAll(&customer{})
+	_ = dir.DeleteAll(&note{})
+	_ = dir.DeleteAll(&member{})
+	_ = dir.DeleteAll(&subscriber{})
+	_ = dir.DeleteAll(&tenantMember{})
 }
 
 func afterEach() {
@@ -61,6 +162,15 @@ func afterEach() {
 	_ = dir.DeleteAll(&userV3{})
 	_ = dir.DeleteAll(&todoList{})
 	_ = dir.DeleteAll(&todoItem{})
+	_ = dir.DeleteAll(&event{})
+	_ = dir.DeleteAll(&account{})
+	_ = dir.DeleteAll(&ticket{})
+	_ = dir.DeleteAll(&product{})
+	_ = dir.DeleteAll(&customer{})
+	_ = dir.DeleteAll(&note{})
+	_ = dir.DeleteAll(&member{})
+	_ = dir.DeleteAll(&subscriber{})
+	_ = dir.DeleteAll(&tenantMember{})
 }
 
 func TestGetID(t *testing.T) {
@@ -620,10 +730,19 @@ func TestFindWithORedWhereClauses(t *testing.T) {
 		t.Fatal("Found users don't match expected users")
 	}
 
+	clauses := []Where{{Field: "Age", Equals: 23}, {Field: "Age", Equals: 17}}
+	spreadUsers := []userV3{}
+	err = dir.Find(&spreadUsers, Wheres(clauses))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(spreadUsers, serializedUsers) {
+		t.Fatal("Clauses passed as Wheres found:", spreadUsers)
+	}
+
 	afterEach()
 }
 
-
 func TestFindWithIntPassedAsString(t *testing.T) {
 	beforeEach()
 
@@ -668,3 +787,3153 @@ func TestFindWithIntPassedAsString(t *testing.T) {
 
 	afterEach()
 }
+
+func TestWriteToDiskLeavesNoTempFiles(t *testing.T) {
+	beforeEach()
+
+	newUser := &user{Name: faker.Name().Name()}
+	err := dir.Create(newUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dir.Replace(newUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(dir.Path + "/gorialize.user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if isTempFile(f.Name()) {
+			t.Fatal("Temp file left behind:", f.Name())
+		}
+	}
+
+	afterEach()
+}
+
+func TestNewDirectoryRemovesTempFiles(t *testing.T) {
+	beforeEach()
+
+	newUser := &user{Name: faker.Name().Name()}
+	err := dir.Create(newUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpPath := filepath.Join(dir.Path, "gorialize.user", ".0000042.123456"+tmpFileSuffix)
+	err = ioutil.WriteFile(tmpPath, []byte("half-written"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	beforeEach()
+
+	if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Fatal("Temp file was not removed by NewDirectory")
+	}
+
+	afterEach()
+}
+
+func TestOpenDirectoryWithCorruptIndexLog(t *testing.T) {
+	path := "/tmp/gorialize/gorialize_test_corrupt"
+	err := os.MkdirAll(path, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	err = ioutil.WriteFile(path+"/.idxlog", []byte("+gorialize.userV3:Age:23=1\n?garbage\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenDirectory(DirectoryConfig{Path: path})
+	var corrupt *ErrCorruptIndexLog
+	if !errors.As(err, &corrupt) {
+		t.Fatal("Expected ErrCorruptIndexLog, got:", err)
+	}
+	if corrupt.Line != 2 || corrupt.Text != "?garbage" {
+		t.Fatalf("Unexpected line %d: %q", corrupt.Line, corrupt.Text)
+	}
+}
+
+func TestThwartIOBasePathEscape(t *testing.T) {
+	beforeEach()
+
+	err := dir.readFromCustomSubdirectory(&user{}, 1, "../etc")
+	var escape *ErrPathEscape
+	if !errors.As(err, &escape) {
+		t.Fatal("Expected ErrPathEscape, got:", err)
+	}
+
+	afterEach()
+}
+
+func TestSentinelErrors(t *testing.T) {
+	beforeEach()
+
+	type neverStored struct{ ID int }
+	err := dir.Read(&neverStored{}, 1)
+	if !errors.Is(err, ErrModelDirMissing) {
+		t.Fatal("Expected ErrModelDirMissing, got:", err)
+	}
+
+	newUser := &userV3{Name: "John Doe", Age: 42}
+	err = dir.Create(newUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dir.Read(&userV3{}, newUser.ID+1)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatal("Expected ErrNotFound, got:", err)
+	}
+	var queryErr *QueryError
+	if !errors.As(err, &queryErr) {
+		t.Fatal("Expected QueryError, got:", err)
+	}
+	if queryErr.Op != "read" || queryErr.Model != "gorialize.userV3" || queryErr.ID != newUser.ID+1 {
+		t.Fatal("QueryError doesn't describe the failed query:", queryErr)
+	}
+
+	err = dir.Find(&[]userV3{}, Where{Field: "Name", Equals: "Jane Doe"})
+	if !errors.Is(err, ErrNoMatches) {
+		t.Fatal("Expected ErrNoMatches, got:", err)
+	}
+
+	err = dir.Replace(&struct{ Name string }{})
+	if !errors.Is(err, ErrNoIDField) {
+		t.Fatal("Expected ErrNoIDField, got:", err)
+	}
+
+	_, err = OpenDirectory(DirectoryConfig{
+		Path:       dir.Path,
+		Encrypted:  true,
+		Passphrase: "wrong-password",
+	})
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatal("Expected ErrDecrypt, got:", err)
+	}
+	wrongKeyDir := *dir
+	wrongKeyDir.Key = legacyKey("wrong-password")
+	err = wrongKeyDir.Read(&userV3{}, newUser.ID)
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatal("Expected ErrDecrypt, got:", err)
+	}
+
+	afterEach()
+}
+
+func BenchmarkRead(b *testing.B) {
+	beforeEach()
+
+	newUser := &userV3{Name: "John Doe", Age: 42}
+	err := dir.Create(newUser)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := dir.Read(&userV3{}, newUser.ID)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	afterEach()
+}
+
+func BenchmarkParallelRead(b *testing.B) {
+	beforeEach()
+
+	newUser := &userV3{Name: "John Doe", Age: 42}
+	err := dir.Create(newUser)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			err := dir.Read(&userV3{}, newUser.ID)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.StopTimer()
+
+	afterEach()
+}
+
+func BenchmarkParallelFind(b *testing.B) {
+	beforeEach()
+
+	newUser := &userV3{Name: "John Doe", Age: 42}
+	err := dir.Create(newUser)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = dir.Create(&todoList{Title: "Groceries"})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			i++
+			var err error
+			if i%2 == 0 {
+				_, err = dir.Count(&todoList{})
+			} else {
+				err = dir.Find(&[]userV3{}, Where{Field: "Age", Equals: 42})
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.StopTimer()
+
+	afterEach()
+}
+
+func BenchmarkParallelReadWhileCreatingOtherModel(b *testing.B) {
+	beforeEach()
+
+	newUser := &userV3{Name: "John Doe", Age: 42}
+	err := dir.Create(newUser)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				_ = dir.Create(&todoList{Title: "Groceries"})
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			err := dir.Read(&userV3{}, newUser.ID)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.StopTimer()
+	close(done)
+
+	afterEach()
+}
+
+func TestSingleWriter(t *testing.T) {
+	config := DirectoryConfig{
+		Path:         "/tmp/gorialize/gorialize_test_single_writer",
+		SingleWriter: true,
+	}
+	defer os.RemoveAll(config.Path)
+
+	writer, err := OpenDirectory(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenDirectory(config)
+	if !errors.Is(err, ErrDirectoryLocked) {
+		t.Fatal("Expected ErrDirectoryLocked, got:", err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err = OpenDirectory(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateFromConcurrentProcesses(t *testing.T) {
+	if os.Getenv("GORIALIZE_TEST_HELPER") == "create" {
+		helperDir := NewDirectory(DirectoryConfig{Path: "/tmp/gorialize/gorialize_test_processes"})
+		for i := 0; i < 20; i++ {
+			err := helperDir.Create(&user{Name: faker.Name().Name()})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return
+	}
+
+	path := "/tmp/gorialize/gorialize_test_processes"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+
+	helpers := []*exec.Cmd{}
+	for i := 0; i < 3; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestCreateFromConcurrentProcesses$")
+		cmd.Env = append(os.Environ(), "GORIALIZE_TEST_HELPER=create")
+		err := cmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		helpers = append(helpers, cmd)
+	}
+	for _, cmd := range helpers {
+		err := cmd.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users := []user{}
+	err := NewDirectory(DirectoryConfig{Path: path}).ReadAll(&users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 60 {
+		t.Fatalf("Found: %d, expected: %d", len(users), 60)
+	}
+}
+
+func TestFindSeesWritesOfOtherDirectories(t *testing.T) {
+	config := DirectoryConfig{Path: "/tmp/gorialize/gorialize_test_other_writers"}
+	os.RemoveAll(config.Path)
+	defer os.RemoveAll(config.Path)
+
+	reader, err := OpenDirectory(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := OpenDirectory(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	find := func(name string, expectedCount int) {
+		users := []userV3{}
+		err := reader.Find(&users, Where{Field: "Name", Equals: name})
+		if errors.Is(err, ErrNoMatches) {
+			err = nil
+		}
+		if err != nil || len(users) != expectedCount {
+			t.Fatalf("Found %d users named %s, expected %d: %v", len(users), name, expectedCount, err)
+		}
+		n, err := reader.Count(&userV3{}, Where{Field: "Name", Equals: name})
+		if err != nil || n != expectedCount {
+			t.Fatalf("Counted %d users named %s, expected %d: %v", n, name, expectedCount, err)
+		}
+	}
+
+	find("John Doe", 0)
+	err = writer.Create(&userV3{Name: "John Doe", Age: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	find("John Doe", 1)
+
+	// Compacted by the other directory
+	err = writer.CompactIndex()
+	if err == nil {
+		err = writer.Create(&userV3{Name: "Jane Doe", Age: 41})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	find("John Doe", 1)
+	find("Jane Doe", 1)
+}
+
+func TestTxCommit(t *testing.T) {
+	beforeEach()
+
+	tx := dir.Begin()
+	newTodoList := &todoList{Title: faker.Lorem().Sentence(3)}
+	err := tx.Create(newTodoList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTodoItems := []*todoItem{}
+	for i := 0; i < testIterationCount; i++ {
+		newTodoItem := &todoItem{
+			TodoListID: newTodoList.ID,
+			Text:       faker.Lorem().Sentence(7),
+		}
+		err = tx.Create(newTodoItem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newTodoItems = append(newTodoItems, newTodoItem)
+	}
+
+	stagedTodoItem := &todoItem{}
+	err = tx.Read(stagedTodoItem, newTodoItems[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stagedTodoItem.Text != newTodoItems[0].Text {
+		t.Fatal("Texts don't equal")
+	}
+
+	err = dir.Read(&todoItem{}, newTodoItems[0].ID)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatal("Staged resource is visible outside of the transaction")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, newTodoItem := range newTodoItems {
+		serializedTodoList := &todoList{}
+		err = dir.GetOwner(newTodoItem, serializedTodoList)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serializedTodoList.Title != newTodoList.Title {
+			t.Fatal("Titles don't equal")
+		}
+	}
+
+	err = tx.Commit()
+	if !errors.Is(err, ErrTxDone) {
+		t.Fatal("Expected ErrTxDone, got:", err)
+	}
+
+	afterEach()
+}
+
+func TestTxWritesSchemas(t *testing.T) {
+	path := "/tmp/gorialize/gorialize_test_tx_schema"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	txDir, err := OpenDirectory(DirectoryConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := txDir.Begin()
+	err = tx.Create(&todoList{Title: "Groceries"})
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	model, resourceType, err := txDir.readSchema(path + "/gorialize.todoList/metadata")
+	if err != nil || model != "gorialize.todoList" || resourceType == nil {
+		t.Fatal("Schema not written by transaction:", model, resourceType, err)
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	beforeEach()
+
+	tx := dir.Begin()
+	err := tx.Create(&userV3{Name: "John Doe", Age: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dir.Find(&[]userV3{}, Where{Field: "Name", Equals: "John Doe"})
+	if !errors.Is(err, ErrNoMatches) {
+		t.Fatal("Expected ErrNoMatches, got:", err)
+	}
+
+	err = tx.Create(&userV3{Name: "John Doe", Age: 42})
+	if !errors.Is(err, ErrTxDone) {
+		t.Fatal("Expected ErrTxDone, got:", err)
+	}
+
+	afterEach()
+}
+
+func TestTxFind(t *testing.T) {
+	beforeEach()
+
+	newUsers := []userV3{}
+	for _, age := range []int{17, 23, 23} {
+		user := userV3{Name: "John Doe", Age: uint(age)}
+		err := dir.Create(&user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newUsers = append(newUsers, user)
+	}
+
+	tx := dir.Begin()
+	newUsers[0].Age = 23
+	err := tx.Replace(&newUsers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Delete(&newUsers[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	stagedUser := userV3{Name: "Jane Doe", Age: 23}
+	err = tx.Create(&stagedUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stagedUsers := []userV3{}
+	err = tx.Find(&stagedUsers, Where{Field: "Age", Equals: 23})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedUsers := []userV3{newUsers[0], newUsers[2], stagedUser}
+	if !reflect.DeepEqual(expectedUsers, stagedUsers) {
+		t.Fatal("Found users don't match staged users:", stagedUsers)
+	}
+
+	serializedUsers := []userV3{}
+	err = dir.Find(&serializedUsers, Where{Field: "Age", Equals: 17})
+	if err != nil || len(serializedUsers) != 1 {
+		t.Fatal("Staged writes are visible outside of the transaction")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serializedUsers = []userV3{}
+	err = dir.Find(&serializedUsers, Where{Field: "Age", Equals: 23})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serializedUsers) != 3 {
+		t.Fatalf("Found: %d, expected: %d", len(serializedUsers), 3)
+	}
+
+	afterEach()
+}
+
+func TestRecoverInterruptedCommit(t *testing.T) {
+	beforeEach()
+
+	tx := dir.Begin()
+	newUser := &userV3{Name: "John Doe", Age: 42}
+	err := tx.Create(newUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash right after the journal has been persisted.
+	w := tx.writes[0]
+	journal := &txJournal{
+		Writes: []txJournalWrite{{
+			DirPath:      w.DirPath,
+			ResourcePath: w.ResourcePath,
+			GobBuffer:    w.GobBuffer,
+		}},
+		IndexLogEntries: w.IndexLogEntries,
+	}
+	if info, err := os.Stat(dir.IndexLogPath); err == nil {
+		journal.IndexLogSize = info.Size()
+	}
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := dir.seal(buf.Bytes())
+	if err == nil {
+		err = writeToDisk(dir.journalPath(), sealed)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, err := dir.formatLogEntries(w.IndexLogEntries[:1])
+	if err == nil {
+		err = appendToDisk(dir.IndexLogPath, lines)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recoveredDir, err := OpenDirectory(DirectoryConfig{
+		Path:       dir.Path,
+		Encrypted:  true,
+		Passphrase: "password123",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serializedUser := &userV3{}
+	err = recoveredDir.Read(serializedUser, newUser.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serializedUser.Name != newUser.Name {
+		t.Fatal("Names don't equal")
+	}
+	ids := recoveredDir.Index.getIDs("gorialize.userV3", "Name", "John Doe")
+	if !reflect.DeepEqual(ids, []int{newUser.ID}) {
+		t.Fatal("Index doesn't point to recovered resource exactly once:", ids)
+	}
+	if _, err := os.Stat(dir.journalPath()); !os.IsNotExist(err) {
+		t.Fatal("Journal was not removed after recovery")
+	}
+
+	dir = recoveredDir
+	afterEach()
+}
+
+func TestRecoverJournalOutsideDirectory(t *testing.T) {
+	beforeEach()
+
+	outside := "/tmp/gorialize/gorialize_test_outside"
+	defer os.Remove(outside)
+	for _, w := range []txJournalWrite{
+		{DirPath: "/tmp/gorialize", ResourcePath: outside, GobBuffer: []byte("planted")},
+		{DirPath: dir.Path + "/gorialize.user", ResourcePath: dir.Path + "/gorialize.user/../../gorialize_test_outside"},
+		{DirPath: dir.Path, ResourcePath: dir.Path + "/.keyparams", Delete: true},
+	} {
+		var buf bytes.Buffer
+		err := gob.NewEncoder(&buf).Encode(&txJournal{Writes: []txJournalWrite{w}})
+		var b []byte
+		if err == nil {
+			b, err = dir.seal(buf.Bytes())
+		}
+		if err == nil {
+			err = writeToDisk(dir.journalPath(), b)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = OpenDirectory(DirectoryConfig{Path: dir.Path, Encrypted: true, Passphrase: "password123"})
+		var escape *ErrPathEscape
+		if !errors.As(err, &escape) {
+			t.Fatal("Expected ErrPathEscape recovering journal writing outside of the directory, got:", err)
+		}
+		if _, err := os.Stat(outside); !os.IsNotExist(err) {
+			t.Fatal("Journal wrote outside of the directory")
+		}
+		if _, err := os.Stat(keyParamsPath(dir.Path)); err != nil {
+			t.Fatal("Journal deleted key parameters:", err)
+		}
+	}
+	err := deleteFromDisk(dir.journalPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	afterEach()
+}
+
+func TestTxCommitWithConcurrentCreates(t *testing.T) {
+	beforeEach()
+
+	errs := make(chan error, 2)
+	go func() {
+		for i := 0; i < 300; i++ {
+			tx := dir.Begin()
+			err := tx.Create(&userV3{Name: "John Doe", Age: 42})
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	go func() {
+		for i := 0; i < 300; i++ {
+			err := dir.Create(&member{Name: "Jane Doe", Email: fmt.Sprintf("jane%d@example.com", i)})
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Minute):
+			t.Fatal("Commit and Create deadlocked")
+		}
+	}
+
+	afterEach()
+}
+
+func sortedIndexKV(idx Index) map[string][]int {
+	kv := map[string][]int{}
+	for key, ids := range idx.KV {
+		kv[key] = append([]int(nil), ids...)
+		sort.Ints(kv[key])
+	}
+	return kv
+}
+
+func TestCompactIndex(t *testing.T) {
+	beforeEach()
+
+	for _, age := range []int{17, 36, 23, 56, 19, 23} {
+		user := userV3{Name: faker.Name().Name(), Age: uint(age)}
+		err := dir.Create(&user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.Age++
+		err = dir.Replace(&user)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectedKV := sortedIndexKV(dir.Index)
+	uncompactedLog, err := ioutil.ReadFile(dir.IndexLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dir.CompactIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compactedLog, err := ioutil.ReadFile(dir.IndexLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gen, _, _ := readIndexLogGen(dir.IndexLogPath); len(compactedLog) != len(indexLogHeader(gen)) {
+		t.Fatal("Index log was not truncated:", string(compactedLog))
+	}
+
+	reopen := func() {
+		dir = NewDirectory(DirectoryConfig{
+			Path:       "/tmp/gorialize/gorialize_test",
+			Encrypted:  true,
+			Passphrase: "password123",
+		})
+	}
+	reopen()
+	if !reflect.DeepEqual(expectedKV, sortedIndexKV(dir.Index)) {
+		t.Fatal("Index replayed from snapshot doesn't match compacted index")
+	}
+
+	// Simulate a crash after the snapshot was written but before the log was truncated.
+	err = ioutil.WriteFile(dir.IndexLogPath, uncompactedLog, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopen()
+	if !reflect.DeepEqual(expectedKV, sortedIndexKV(dir.Index)) {
+		t.Fatal("Index replayed from snapshot and stale log doesn't match compacted index")
+	}
+
+	serializedUsers := []userV3{}
+	err = dir.Find(&serializedUsers, Where{Field: "Age", Equals: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serializedUsers) != 2 {
+		t.Fatalf("Found: %d, expected: %d", len(serializedUsers), 2)
+	}
+
+	afterEach()
+}
+
+func TestAutoCompactIndex(t *testing.T) {
+	beforeEach()
+	dir = NewDirectory(DirectoryConfig{
+		Path:                   "/tmp/gorialize/gorialize_test",
+		Encrypted:              true,
+		Passphrase:             "password123",
+		CompactIndexAfterLines: 10,
+	})
+
+	for i := 0; i < 4*testIterationCount; i++ {
+		err := dir.Create(&userV3{Name: "John Doe", Age: uint(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dir.indexLog.lines >= 10 {
+		t.Fatal("Index log has not been compacted:", dir.indexLog.lines)
+	}
+
+	serializedUsers := []userV3{}
+	err := NewDirectory(DirectoryConfig{
+		Path:       "/tmp/gorialize/gorialize_test",
+		Encrypted:  true,
+		Passphrase: "password123",
+	}).Find(&serializedUsers, Where{Field: "Name", Equals: "John Doe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serializedUsers) != 4*testIterationCount {
+		t.Fatalf("Found: %d, expected: %d", len(serializedUsers), 4*testIterationCount)
+	}
+
+	afterEach()
+}
+
+func TestRebuildIndex(t *testing.T) {
+	beforeEach()
+
+	newUsers := []userV3{}
+	for _, age := range []int{17, 36, 23, 56, 19, 23} {
+		user := userV3{Name: faker.Name().Name(), Age: uint(age)}
+		err := dir.Create(&user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newUsers = append(newUsers, user)
+	}
+	expectedKV := sortedIndexKV(dir.Index)
+
+	err := os.Remove(dir.IndexLogPath)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	os.Remove(dir.indexSnapshotPath())
+	dir = NewDirectory(DirectoryConfig{
+		Path:       "/tmp/gorialize/gorialize_test",
+		Encrypted:  true,
+		Passphrase: "password123",
+	})
+	if len(dir.Index.getIDs("gorialize.userV3", "Age", 23)) > 0 {
+		t.Fatal("Index still contains entries after the index log was removed")
+	}
+
+	err = dir.RebuildIndex(&userV3{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expectedKV, sortedIndexKV(dir.Index)) {
+		t.Fatal("Rebuilt index doesn't match original index")
+	}
+
+	serializedUsers := []userV3{}
+	err = dir.Find(&serializedUsers, Where{Field: "Age", Equals: 23})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serializedUsers) != 2 {
+		t.Fatalf("Found: %d, expected: %d", len(serializedUsers), 2)
+	}
+
+	afterEach()
+}
+
+func TestRebuildIndexWithConcurrentProcesses(t *testing.T) {
+	config := DirectoryConfig{Path: "/tmp/gorialize/gorialize_test_rebuild_processes"}
+	if os.Getenv("GORIALIZE_TEST_HELPER") == "create-indexed" {
+		helperDir := NewDirectory(config)
+		for i := 0; i < 200; i++ {
+			err := helperDir.Create(&userV3{Name: "John Doe", Age: 42})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return
+	}
+
+	os.RemoveAll(config.Path)
+	defer os.RemoveAll(config.Path)
+	rebuildDir := NewDirectory(config)
+	err := rebuildDir.Create(&userV3{Name: "John Doe", Age: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRebuildIndexWithConcurrentProcesses$")
+	cmd.Env = append(os.Environ(), "GORIALIZE_TEST_HELPER=create-indexed")
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	for rebuilding := true; rebuilding; {
+		select {
+		case err = <-done:
+			rebuilding = false
+		default:
+			err = rebuildDir.RebuildIndex(&userV3{})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := NewDirectory(config).Count(&userV3{}, Where{Field: "Name", Equals: "John Doe"})
+	if err != nil || n != 201 {
+		t.Fatalf("Counted %d indexed users, expected 201: %v", n, err)
+	}
+}
+
+func TestRebuildIndexFromSchema(t *testing.T) {
+	beforeEach()
+
+	for _, age := range []int{17, 36, 23, 56, 19, 23} {
+		err := dir.Create(&userV3{Name: faker.Name().Name(), Age: uint(age)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectedKV := sortedIndexKV(dir.Index)
+
+	model, resourceType, err := dir.readSchema(dir.Path + "/gorialize.userV3/metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model != "gorialize.userV3" {
+		t.Fatal("Schema doesn't record the model name:", model)
+	}
+	dir.Index.removeModel("gorialize.userV3")
+	_, err = dir.rebuildIndex(map[string]reflect.Type{"gorialize.userV3": resourceType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expectedKV, sortedIndexKV(dir.Index)) {
+		t.Fatal("Index rebuilt from schema doesn't match original index")
+	}
+
+	afterEach()
+}
+
+func TestFindWithComparisonOperators(t *testing.T) {
+	beforeEach()
+
+	newUsers := []userV3{}
+	for _, age := range []int{17, 36, 23, 56, 19, 65, 18} {
+		user := userV3{Name: faker.Name().Name(), Age: uint(age)}
+		err := dir.Create(&user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newUsers = append(newUsers, user)
+	}
+
+	cases := []struct {
+		where        Where
+		expectedAges []uint
+	}{
+		{Where{Field: "Age", Between: []interface{}{18, 65}}, []uint{18, 19, 23, 36, 56, 65}},
+		{Where{Field: "Age", Gt: 18, Lt: 65}, []uint{19, 23, 36, 56}},
+		{Where{Field: "Age", Gte: 56}, []uint{56, 65}},
+		{Where{Field: "Age", Lte: "18"}, []uint{17, 18}},
+		{Where{Field: "Age", Lt: 65, And: &Where{Field: "Age", Gt: 30}}, []uint{36, 56}},
+	}
+	for _, c := range cases {
+		serializedUsers := []userV3{}
+		err := dir.Find(&serializedUsers, c.where)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ages := []uint{}
+		for _, u := range serializedUsers {
+			ages = append(ages, u.Age)
+		}
+		sort.Slice(ages, func(i, j int) bool { return ages[i] < ages[j] })
+		if !reflect.DeepEqual(c.expectedAges, ages) {
+			t.Fatalf("Found ages: %v, expected: %v", ages, c.expectedAges)
+		}
+	}
+
+	// The sorted index is kept in sync with later writes.
+	newUsers[0].Age = 40
+	err := dir.Replace(&newUsers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	serializedUsers := []userV3{}
+	err = dir.Find(&serializedUsers, Where{Field: "Age", Between: []interface{}{37, 55}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serializedUsers) != 1 || serializedUsers[0].ID != newUsers[0].ID {
+		t.Fatal("Sorted index doesn't reflect replaced resource")
+	}
+
+	err = dir.Find(&serializedUsers, Where{Field: "Age", Gt: "old"})
+	if err == nil {
+		t.Fatal("Comparing uint field with non-numeric string should fail")
+	}
+
+	afterEach()
+}
+
+func TestFindWithComparisonOperatorsOnFloatsStringsAndTimes(t *testing.T) {
+	beforeEach()
+
+	yesterday := time.Now().Add(-24 * time.Hour)
+	for i, title := range []string{"alpha", "bravo", "charlie", "delta"} {
+		err := dir.Create(&event{
+			Title:     title,
+			Score:     float64(i) + 0.5,
+			CreatedAt: yesterday.Add(time.Duration(i-2) * time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		where          Where
+		expectedTitles []string
+	}{
+		{Where{Field: "Score", Gt: 1.5}, []string{"charlie", "delta"}},
+		{Where{Field: "Title", Between: []interface{}{"b", "charlie"}}, []string{"bravo", "charlie"}},
+		{Where{Field: "CreatedAt", Gte: yesterday}, []string{"charlie", "delta"}},
+	}
+	for _, c := range cases {
+		events := []event{}
+		err := dir.Find(&events, c.where)
+		if err != nil {
+			t.Fatal(err)
+		}
+		titles := []string{}
+		for _, e := range events {
+			titles = append(titles, e.Title)
+		}
+		sort.Strings(titles)
+		if !reflect.DeepEqual(c.expectedTitles, titles) {
+			t.Fatalf("Found titles: %v, expected: %v", titles, c.expectedTitles)
+		}
+	}
+
+	afterEach()
+}
+
+func TestFindWithOrderByLimitAndOffset(t *testing.T) {
+	beforeEach()
+
+	// ids[n] is the ID of the n-th created user.
+	ids := []int{0}
+	for _, age := range []int{36, 17, 56, 23, 36, 19} {
+		user := userV3{Name: faker.Name().Name(), Age: uint(age)}
+		err := dir.Create(&user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, user.ID)
+	}
+
+	cases := []struct {
+		options     []QueryOption
+		expectedIDs []int
+	}{
+		{[]QueryOption{}, []int{ids[1], ids[2], ids[3], ids[4], ids[5], ids[6]}},
+		{[]QueryOption{OrderBy("Age", Asc)}, []int{ids[2], ids[6], ids[4], ids[1], ids[5], ids[3]}},
+		{[]QueryOption{OrderBy("Age", Desc)}, []int{ids[3], ids[5], ids[1], ids[4], ids[6], ids[2]}},
+		{[]QueryOption{OrderBy("Age", Asc), Limit(2)}, []int{ids[2], ids[6]}},
+		{[]QueryOption{OrderBy("Age", Asc), Offset(2), Limit(3)}, []int{ids[4], ids[1], ids[5]}},
+		{[]QueryOption{OrderBy("Age", Desc), Offset(10)}, []int{}},
+		{[]QueryOption{Where{Field: "Age", Gt: 18}, OrderBy("Age", Desc), Limit(2)}, []int{ids[3], ids[5]}},
+	}
+	for _, c := range cases {
+		serializedUsers := []userV3{}
+		err := dir.ReadAll(&serializedUsers, c.options...)
+		if len(c.options) > 0 {
+			if _, ok := c.options[0].(Where); ok {
+				serializedUsers = []userV3{}
+				err = dir.Find(&serializedUsers, c.options...)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		readIDs := []int{}
+		for _, u := range serializedUsers {
+			readIDs = append(readIDs, u.ID)
+		}
+		if !reflect.DeepEqual(c.expectedIDs, readIDs) {
+			t.Fatalf("Read IDs: %v, expected: %v", readIDs, c.expectedIDs)
+		}
+	}
+
+	// Non-indexed fields are sorted by decoding the resources.
+	for _, age := range []int{36, 17, 56} {
+		err := dir.Create(&user{Name: faker.Name().Name(), Age: uint(age)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	serializedUsers := []user{}
+	err := dir.ReadAll(&serializedUsers, OrderBy("Age", Desc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serializedUsers) != 3 || serializedUsers[0].Age != 56 || serializedUsers[2].Age != 17 {
+		t.Fatalf("Resources not sorted by non-indexed field: %v", serializedUsers)
+	}
+
+	err = dir.ReadAll(&serializedUsers, Where{Field: "Age", Equals: 17})
+	if err == nil {
+		t.Fatal("ReadAll should not take where clauses")
+	}
+
+	afterEach()
+}
+
+func TestFindWithCursor(t *testing.T) {
+	beforeEach()
+
+	// ids[n] is the ID of the n-th created event.
+	ids := []int{0}
+	start := time.Now()
+	for i := 0; i < 7; i++ {
+		e := event{
+			Title:     fmt.Sprintf("event %d", i),
+			CreatedAt: start.Add(time.Duration(i%3) * time.Minute),
+		}
+		err := dir.Create(&e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, e.ID)
+	}
+
+	// Cursors keep their position when resources are deleted between pages.
+	pagedIDs := []int{}
+	cursor := ""
+	for page := 0; ; page++ {
+		events := []event{}
+		err := dir.Find(&events,
+			Where{Field: "CreatedAt", Gte: start},
+			OrderBy("CreatedAt", Desc),
+			Limit(2),
+			After(cursor),
+			NextCursor(&cursor),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range events {
+			pagedIDs = append(pagedIDs, e.ID)
+		}
+		if page == 0 {
+			err = dir.Delete(&event{ID: ids[1]})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if cursor == "" {
+			break
+		}
+	}
+	expectedIDs := []int{ids[6], ids[3], ids[5], ids[2], ids[7], ids[4]}
+	if !reflect.DeepEqual(expectedIDs, pagedIDs) {
+		t.Fatalf("Paged IDs: %v, expected: %v", pagedIDs, expectedIDs)
+	}
+
+	events := []event{}
+	cursor = ""
+	err := dir.ReadAll(&events, Limit(3), NextCursor(&cursor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dir.ReadAll(&events, After(cursor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 6 || events[3].ID != ids[5] {
+		t.Fatalf("Cursor on ID order returned wrong resources: %v", events)
+	}
+
+	err = dir.ReadAll(&events, OrderBy("Title", Asc), After(cursor))
+	if err == nil {
+		t.Fatal("Cursor should not be accepted for a different order")
+	}
+
+	afterEach()
+}
+
+func TestFindOnNonIndexedFields(t *testing.T) {
+	beforeEach()
+
+	for _, age := range []int{17, 23, 42, 23} {
+		err := dir.Create(&user{Name: faker.Name().Name(), Age: uint(age)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		options      []QueryOption
+		expectedAges []uint
+	}{
+		{[]QueryOption{Where{Field: "Age", Equals: 23}}, []uint{23, 23}},
+		{[]QueryOption{Where{Field: "Age", In: []interface{}{17, "42"}}}, []uint{17, 42}},
+		{[]QueryOption{Where{Field: "Age", Gt: 20, And: &Where{Field: "Age", Lt: 40}}}, []uint{23, 23}},
+		{[]QueryOption{Where{Field: "Age", Equals: 17}, Where{Field: "Age", Gte: 42}}, []uint{17, 42}},
+		{[]QueryOption{Where{Filter: func(resource interface{}) bool {
+			return resource.(*user).Age%2 == 0
+		}}}, []uint{42}},
+		{[]QueryOption{Filter(func(resource interface{}) bool {
+			return resource.(*user).Age > 20
+		})}, []uint{23, 42, 23}},
+	}
+	for _, c := range cases {
+		serializedUsers := []user{}
+		err := dir.Find(&serializedUsers, c.options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ages := []uint{}
+		for _, u := range serializedUsers {
+			ages = append(ages, u.Age)
+		}
+		if !reflect.DeepEqual(c.expectedAges, ages) {
+			t.Fatalf("Found ages: %v, expected: %v", ages, c.expectedAges)
+		}
+	}
+
+	err := dir.Find(&[]user{}, Where{Field: "Age", Equals: 99})
+	if !errors.Is(err, ErrNoMatches) {
+		t.Fatal("Expected ErrNoMatches, got:", err)
+	}
+	err = dir.Find(&[]user{}, Where{Field: "Nickname", Equals: "Jo"})
+	if err == nil {
+		t.Fatal("Querying a field the type doesn't have should fail")
+	}
+
+	afterEach()
+}
+
+func TestFindWithIndexedNarrowingAndResidualFilter(t *testing.T) {
+	beforeEach()
+
+	for _, name := range []string{"John Doe", "Jane Doe", "John Smith"} {
+		for _, age := range []int{23, 42} {
+			err := dir.Create(&userV3{Name: name, Age: uint(age)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	decoded := 0
+	adult := func(resource interface{}) bool {
+		decoded++
+		return resource.(*userV3).Age >= 40
+	}
+	serializedUsers := []userV3{}
+	err := dir.Find(&serializedUsers,
+		Where{Field: "Name", Equals: "John Doe", And: &Where{Filter: adult}},
+		Where{Field: "Name", Equals: "Jane Doe"},
+		Filter(func(resource interface{}) bool {
+			return resource.(*userV3).Age != 23
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serializedUsers) != 2 || serializedUsers[0].Name != "John Doe" || serializedUsers[1].Name != "Jane Doe" {
+		t.Fatalf("Found wrong users: %v", serializedUsers)
+	}
+	if decoded != 2 {
+		t.Fatalf("Filter called for %d resources, expected the 2 narrowed down by the index", decoded)
+	}
+
+	serializedUsers = []userV3{}
+	err = dir.ReadAll(&serializedUsers, Filter(func(resource interface{}) bool {
+		return strings.HasPrefix(resource.(*userV3).Name, "John")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serializedUsers) != 4 {
+		t.Fatalf("ReadAll returned %d users passing the filter, expected 4", len(serializedUsers))
+	}
+
+	afterEach()
+}
+
+func TestUniqueIndex(t *testing.T) {
+	beforeEach()
+
+	john := account{Email: "john@example.com", Name: "John Doe"}
+	err := dir.Create(&john)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jane := account{Email: "jane@example.com", Name: "Jane Doe"}
+	err = dir.Create(&jane)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dir.Create(&account{Email: "john@example.com", Name: "John Smith"})
+	var violation *ErrUniqueViolation
+	if !errors.As(err, &violation) {
+		t.Fatal("Expected *ErrUniqueViolation, got:", err)
+	}
+	if violation.Field != "Email" || violation.Value != "john@example.com" || violation.ID != john.ID {
+		t.Fatalf("Unique violation names the wrong field, value or ID: %+v", violation)
+	}
+	accounts := []account{}
+	err = dir.ReadAll(&accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 2 {
+		t.Fatalf("%d accounts stored, expected 2", len(accounts))
+	}
+
+	jane.Email = john.Email
+	err = dir.Replace(&jane)
+	if !errors.As(err, &violation) {
+		t.Fatal("Expected *ErrUniqueViolation, got:", err)
+	}
+	john.Name = "John Smith"
+	err = dir.Replace(&john)
+	if err != nil {
+		t.Fatal("Replacing a resource with its own unique value should succeed:", err)
+	}
+
+	// Values are checked against other staged writes as well.
+	tx := dir.Begin()
+	_ = tx.Create(&account{Email: "joe@example.com"})
+	_ = tx.Create(&account{Email: "joe@example.com"})
+	err = tx.Commit()
+	if !errors.As(err, &violation) {
+		t.Fatal("Expected *ErrUniqueViolation, got:", err)
+	}
+	tx = dir.Begin()
+	john.Email = "john.doe@example.com"
+	_ = tx.Replace(&john)
+	_ = tx.Create(&account{Email: "john@example.com"})
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal("Reusing a value freed by the same transaction should succeed:", err)
+	}
+
+	afterEach()
+}
+
+func TestUniqueIndexWithConcurrentCreates(t *testing.T) {
+	beforeEach()
+
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			errs <- dir.Create(&account{Email: "john@example.com"})
+		}()
+	}
+	created := 0
+	for i := 0; i < 10; i++ {
+		err := <-errs
+		var violation *ErrUniqueViolation
+		switch {
+		case err == nil:
+			created++
+		case !errors.As(err, &violation):
+			t.Fatal(err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d accounts with the same email created, expected 1", created)
+	}
+
+	afterEach()
+}
+
+func TestCompositeIndex(t *testing.T) {
+	beforeEach()
+
+	tickets := []ticket{}
+	for _, tenantID := range []int{1, 2} {
+		for _, status := range []string{"open", "closed", "open"} {
+			tkt := ticket{TenantID: tenantID, Status: status, Title: faker.Lorem().Sentence(3)}
+			err := dir.Create(&tkt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tickets = append(tickets, tkt)
+		}
+	}
+
+	where := Where{Field: "TenantID", Equals: 2, And: &Where{Field: "Status", Equals: "open"}}
+	q := dir.newQueryWithoutID("find all", &ticket{})
+	q.ReflectTypeOfResource()
+	indexed, residual := q.planWhere(where)
+	if indexed == nil || indexed.Field != "&tenant_status" || indexed.And != nil || len(residual) != 0 {
+		t.Fatalf("Planner didn't answer the clauses from the composite index: %+v, %+v", indexed, residual)
+	}
+
+	serializedTickets := []ticket{}
+	err := dir.Find(&serializedTickets, where)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serializedTickets) != 2 || serializedTickets[0].ID != tickets[3].ID || serializedTickets[1].ID != tickets[5].ID {
+		t.Fatalf("Found wrong tickets: %v", serializedTickets)
+	}
+
+	// The composite index is kept in sync with later writes.
+	tickets[5].Status = "closed"
+	err = dir.Replace(&tickets[5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dir.Delete(&tickets[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	serializedTickets = []ticket{}
+	err = dir.Find(&serializedTickets, Where{Field: "Status", Equals: "closed", And: &Where{Field: "TenantID", Equals: "2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serializedTickets) != 2 || serializedTickets[0].ID != tickets[4].ID || serializedTickets[1].ID != tickets[5].ID {
+		t.Fatalf("Found wrong tickets after replace: %v", serializedTickets)
+	}
+	err = dir.Find(&serializedTickets, where)
+	if !errors.Is(err, ErrNoMatches) {
+		t.Fatal("Expected ErrNoMatches, got:", err)
+	}
+
+	// Fields which are only part of a composite index are scanned for on their own.
+	serializedTickets = []ticket{}
+	err = dir.Find(&serializedTickets, Where{Field: "TenantID", Equals: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serializedTickets) != 3 {
+		t.Fatalf("Found %d tickets of tenant 1, expected 3", len(serializedTickets))
+	}
+
+	afterEach()
+}
+
+func TestCompositeIndexOverLoweredField(t *testing.T) {
+	beforeEach()
+
+	for _, m := range []tenantMember{{TenantID: 1, Email: "Foo@X.com"}, {TenantID: 2, Email: "foo@x.com"}} {
+		err := dir.Create(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	where := Where{Field: "Email", Equals: "FOO@x.com", And: &Where{Field: "TenantID", Equals: 1}}
+	q := dir.newQueryWithoutID("find all", &tenantMember{})
+	q.ReflectTypeOfResource()
+	indexed, _ := q.planWhere(where)
+	if indexed == nil || indexed.Field != "&tenant_email" {
+		t.Fatalf("Planner didn't answer the clauses from the composite index: %+v", indexed)
+	}
+	members := []tenantMember{}
+	err := dir.Find(&members, where)
+	if err != nil || len(members) != 1 || members[0].TenantID != 1 {
+		t.Fatal("Lowered field not matched in composite index:", members, err)
+	}
+	n, err := dir.Count(&tenantMember{}, where)
+	if err != nil || n != 1 {
+		t.Fatalf("Counted %d, expected 1: %v", n, err)
+	}
+
+	afterEach()
+}
+
+func TestTypedIndexKeys(t *testing.T) {
+	beforeEach()
+
+	names := []string{"42", "a:b=c", "line\nbreak", "100%3A", "x,y"}
+	for i, name := range names {
+		err := dir.Create(&product{Name: name, Price: cents(42 * (i + 1))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	find := func(where Where) ([]product, error) {
+		products := []product{}
+		err := dir.Find(&products, where)
+		return products, err
+	}
+	checkNames := func() {
+		for _, name := range names {
+			products, err := find(Where{Field: "Name", Equals: name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(products) != 1 || products[0].Name != name {
+				t.Fatalf("Found %v for name %q", products, name)
+			}
+		}
+	}
+	checkNames()
+
+	products, err := find(Where{Field: "Price", Equals: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 1 || products[0].Name != "42" {
+		t.Fatalf("Found %v for price 42", products)
+	}
+	products, err = find(Where{Field: "Price", Equals: "84"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 1 || products[0].Price != 84 {
+		t.Fatalf("Found %v for price \"84\"", products)
+	}
+	products, err = find(Where{Field: "Name", Gte: "a:", Lt: "m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 2 || products[0].Name != "a:b=c" || products[1].Name != "line\nbreak" {
+		t.Fatalf("Found %v for names between \"a:\" and \"m\"", products)
+	}
+
+	for _, where := range []Where{
+		{Field: "Name", Equals: 42},
+		{Field: "Price", Equals: "$0.42"},
+		{Field: "Price", Equals: -1.5},
+		{Field: "Price", In: []interface{}{42, "forty-two"}},
+	} {
+		_, err = find(where)
+		if err == nil || errors.Is(err, ErrNoMatches) {
+			t.Fatalf("Expected conversion error for %+v, got: %v", where, err)
+		}
+	}
+
+	// Escaped values round-trip through the index log and its snapshot.
+	reopen := func() {
+		dir = NewDirectory(DirectoryConfig{
+			Path:       "/tmp/gorialize/gorialize_test",
+			Encrypted:  true,
+			Passphrase: "password123",
+		})
+	}
+	reopen()
+	checkNames()
+	err = dir.CompactIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopen()
+	checkNames()
+
+	afterEach()
+}
+
+func TestReplayLegacyIndexLog(t *testing.T) {
+	path := "/tmp/gorialize/gorialize_test_legacy"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+
+	err := os.MkdirAll(path, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createdAt := time.Date(2020, 1, 2, 3, 4, 5, 6, time.FixedZone("CET", 3600))
+	snapshot := "#gen 1\n+gorialize.userV3:Name:John Doe=1\n+gorialize.userV3:Age:42=1\n"
+	log := fmt.Sprintf("#gen 1\n+gorialize.event:CreatedAt:%v=2\n+gorialize.ticket:&tenant_status:\"7\",\"a:b\"=3\n"+
+		"+gorialize.userV3:Name:%v=4\n", createdAt, createdAt)
+	// Only the schemas tell time values from strings which look like them.
+	for model, resource := range map[string]interface{}{"gorialize.event": event{}, "gorialize.userV3": userV3{}} {
+		schema := describeType(reflect.TypeOf(resource))
+		schema.Model = model
+		b, err := json.Marshal(schema)
+		if err == nil {
+			err = os.MkdirAll(path+"/"+model+"/metadata", os.ModePerm)
+		}
+		if err == nil {
+			err = writeToDisk(path+"/"+model+"/metadata/schema", b)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ioutil.WriteFile(path+"/.idxlog.snapshot", []byte(snapshot), 0644)
+	if err == nil {
+		err = ioutil.WriteFile(path+"/.idxlog", []byte(log), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacyDir, err := OpenDirectory(DirectoryConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedKV := map[string][]int{
+		"gorialize.userV3:Name:John Doe":                                {1},
+		"gorialize.userV3:Age:42":                                       {1},
+		"gorialize.event:CreatedAt:2020-01-02T02%3A04%3A05.000000006Z":  {2},
+		"gorialize.ticket:&tenant_status:7,a%3Ab":                       {3},
+		"gorialize.userV3:Name:" + escapeIndexValue(createdAt.String()): {4},
+	}
+	if !reflect.DeepEqual(expectedKV, sortedIndexKV(legacyDir.Index)) {
+		t.Fatalf("Converted index: %v, expected: %v", sortedIndexKV(legacyDir.Index), expectedKV)
+	}
+	if ids := legacyDir.Index.getIDs("gorialize.event", "CreatedAt", createdAt); len(ids) != 1 {
+		t.Fatal("Converted time value not found")
+	}
+	if ids := legacyDir.Index.getIDs("gorialize.userV3", "Name", createdAt.String()); len(ids) != 1 {
+		t.Fatal("String value which looks like a time not found")
+	}
+
+	for _, p := range []string{path + "/.idxlog", path + "/.idxlog.snapshot"} {
+		if _, legacy, err := readIndexLogGen(p); err != nil || legacy {
+			t.Fatalf("%s not rewritten in the current format: %v", p, err)
+		}
+	}
+	legacyDir, err = OpenDirectory(DirectoryConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expectedKV, sortedIndexKV(legacyDir.Index)) {
+		t.Fatalf("Index replayed after conversion: %v, expected: %v", sortedIndexKV(legacyDir.Index), expectedKV)
+	}
+}
+
+func TestNestedAndMultiValueIndexes(t *testing.T) {
+	beforeEach()
+
+	customers := []customer{
+		{
+			Audit:   Audit{CreatedBy: "alice"},
+			Tags:    []string{"go", "db", "go"},
+			Address: address{Street: "Main St", City: "Berlin"},
+			Offices: []*address{{City: "Paris"}, {City: "Rome"}},
+			Scores:  map[string]int{"x": 1},
+		},
+		{
+			Audit:   Audit{CreatedBy: "bob"},
+			Tags:    []string{"db"},
+			Address: address{Street: "High St", City: "Munich"},
+			Scores:  map[string]int{"y": 2},
+		},
+	}
+	for i := range customers {
+		err := dir.Create(&customers[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		where Where
+		ids   []int
+	}{
+		{Where{Field: "Tags", Equals: "db"}, []int{customers[0].ID, customers[1].ID}},
+		{Where{Field: "Tags", Equals: "go"}, []int{customers[0].ID}},
+		{Where{Field: "Tags", In: []interface{}{"go", "db"}, And: &Where{Field: "CreatedBy", Equals: "bob"}}, []int{customers[1].ID}},
+		{Where{Field: "Address.City", Equals: "Munich"}, []int{customers[1].ID}},
+		{Where{Field: "Address.City", Gte: "A", Lt: "C"}, []int{customers[0].ID}},
+		{Where{Field: "Offices.City", Equals: "Rome"}, []int{customers[0].ID}},
+		{Where{Field: "CreatedBy", Equals: "bob"}, []int{customers[1].ID}},
+		{Where{Field: "Audit.CreatedBy", Equals: "alice"}, []int{customers[0].ID}},
+		{Where{Field: "Scores", Equals: "y"}, []int{customers[1].ID}},
+		{Where{Field: "Address.Street", Equals: "Main St"}, []int{customers[0].ID}},
+	}
+	for _, test := range tests {
+		q := dir.newQueryWithoutID("find all", &customer{})
+		q.ReflectTypeOfResource()
+		indexed, _ := q.planWhere(test.where)
+		if test.where.Field != "Address.Street" && indexed == nil {
+			t.Fatalf("Clause on %s wasn't answered from the index", test.where.Field)
+		}
+
+		serializedCustomers := []customer{}
+		err := dir.Find(&serializedCustomers, test.where)
+		if err != nil {
+			t.Fatal(test.where.Field, err)
+		}
+		if len(serializedCustomers) != len(test.ids) {
+			t.Fatalf("Found %d customers for %s, expected %d", len(serializedCustomers), test.where.Field, len(test.ids))
+		}
+		for i, c := range serializedCustomers {
+			if c.ID != test.ids[i] {
+				t.Fatalf("Found wrong customers for %s: %v", test.where.Field, serializedCustomers)
+			}
+		}
+	}
+
+	// Every value of a field with several values is replaced.
+	customers[0].Tags = []string{"rust"}
+	err := dir.Replace(&customers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	serializedCustomers := []customer{}
+	err = dir.Find(&serializedCustomers, Where{Field: "Tags", Equals: "go"})
+	if !errors.Is(err, ErrNoMatches) {
+		t.Fatal("Expected ErrNoMatches, got:", err)
+	}
+
+	err = dir.Find(&serializedCustomers, Where{Field: "Address.City", Gte: "A"}, OrderBy("Address.City", Desc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serializedCustomers) != 2 || serializedCustomers[0].ID != customers[1].ID {
+		t.Fatalf("Customers not ordered by nested field: %v", serializedCustomers)
+	}
+	err = dir.ReadAll(&serializedCustomers, OrderBy("Tags", Asc))
+	if err == nil {
+		t.Fatal("Expected error ordering by a field with several values")
+	}
+	err = dir.Find(&serializedCustomers, Where{Field: "Address.Zip", Equals: "10115"})
+	if err == nil {
+		t.Fatal("Expected error for a nested field which does not exist")
+	}
+
+	afterEach()
+}
+
+func TestFulltextIndex(t *testing.T) {
+	beforeEach()
+
+	notes := []note{
+		{Title: "Gob encoding", Body: "Gobs encode Go values. Gob streams are self-describing.", Author: "rob"},
+		{Title: "Index log", Body: "The index log is replayed on open, then compacted.", Author: "ken"},
+		{Title: "Encryption", Body: "Gob buffers are encrypted with AES-GCM.", Author: "rob"},
+		{Title: "Indexing", Body: "Indexed fields are logged.", Author: "ken"},
+	}
+	for i := range notes {
+		err := dir.Create(&notes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := func(notes []note) (ids []int) {
+		for _, n := range notes {
+			ids = append(ids, n.ID)
+		}
+		return
+	}
+
+	tests := []struct {
+		where Where
+		ids   []int
+	}{
+		{Where{Field: "Body", Match: "GOB"}, []int{notes[0].ID, notes[2].ID}},
+		{Where{Field: "Body", Match: "gob encrypted"}, []int{notes[2].ID}},
+		{Where{Field: "Body", Match: "gob AND encrypted"}, []int{notes[2].ID}},
+		{Where{Field: "Body", Match: "replayed OR logged"}, []int{notes[1].ID, notes[3].ID}},
+		{Where{Field: "Title", Match: "index*"}, []int{notes[1].ID, notes[3].ID}},
+		{Where{Field: "Body", Match: "gob*", And: &Where{Field: "Author", Equals: "rob"}}, []int{notes[0].ID, notes[2].ID}},
+		{Where{Field: "Author", Match: "ken"}, []int{notes[1].ID, notes[3].ID}},
+	}
+	for _, test := range tests {
+		serializedNotes := []note{}
+		err := dir.Find(&serializedNotes, test.where)
+		if err != nil {
+			t.Fatal(test.where.Match, err)
+		}
+		if !reflect.DeepEqual(ids(serializedNotes), test.ids) {
+			t.Fatalf("Found %v for %q, expected %v", ids(serializedNotes), test.where.Match, test.ids)
+		}
+	}
+
+	// Rarer terms rank higher, results are ordered by relevance unless ordered otherwise.
+	serializedNotes := []note{}
+	err := dir.Find(&serializedNotes, Where{Field: "Body", Match: "gob OR encrypted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids(serializedNotes), []int{notes[2].ID, notes[0].ID}) {
+		t.Fatalf("Notes not ranked by relevance: %v", ids(serializedNotes))
+	}
+	cursor := ""
+	serializedNotes = []note{}
+	err = dir.Find(&serializedNotes, Where{Field: "Body", Match: "gob OR encrypted"}, Limit(1), NextCursor(&cursor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serializedNotes = []note{}
+	err = dir.Find(&serializedNotes, Where{Field: "Body", Match: "gob OR encrypted"}, After(cursor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids(serializedNotes), []int{notes[0].ID}) {
+		t.Fatalf("Cursor didn't continue after the most relevant note: %v", ids(serializedNotes))
+	}
+	serializedNotes = []note{}
+	err = dir.Find(&serializedNotes, Where{Field: "Body", Match: "gob OR encrypted"}, OrderBy("Title", Asc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids(serializedNotes), []int{notes[2].ID, notes[0].ID}) {
+		t.Fatalf("Notes not ordered by title: %v", ids(serializedNotes))
+	}
+
+	// The inverted index is updated by Replace and Delete and replayed from the index log.
+	notes[0].Body = "Nothing to see here."
+	err = dir.Replace(&notes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dir.Delete(&notes[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = NewDirectory(DirectoryConfig{
+		Path:       "/tmp/gorialize/gorialize_test",
+		Encrypted:  true,
+		Passphrase: "password123",
+	})
+	serializedNotes = []note{}
+	err = dir.Find(&serializedNotes, Where{Field: "Body", Match: "gob*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids(serializedNotes), []int{notes[2].ID}) {
+		t.Fatalf("Found %v after replace, expected %v", ids(serializedNotes), []int{notes[2].ID})
+	}
+	err = dir.Find(&serializedNotes, Where{Field: "Title", Match: "indexing"})
+	if !errors.Is(err, ErrNoMatches) {
+		t.Fatal("Expected ErrNoMatches, got:", err)
+	}
+	err = dir.Find(&serializedNotes, Where{Field: "Body", Match: "* OR"})
+	if err == nil || errors.Is(err, ErrNoMatches) {
+		t.Fatal("Expected error for a Match query without terms, got:", err)
+	}
+
+	afterEach()
+}
+
+func TestStringMatching(t *testing.T) {
+	beforeEach()
+
+	members := []member{
+		{Name: "John", Email: "John@Example.com", Handle: "@john"},
+		{Name: "Joanna", Email: "joanna@example.org", Handle: "@jo"},
+		{Name: "jonas", Email: "JONAS@EXAMPLE.COM", Handle: "@jonas"},
+		{Name: "Mary Jo", Email: "mary@example.com", Handle: "@mary"},
+	}
+	for i := range members {
+		err := dir.Create(&members[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := func(members []member) (ids []int) {
+		for _, m := range members {
+			ids = append(ids, m.ID)
+		}
+		return
+	}
+
+	tests := []struct {
+		where   Where
+		indexed bool
+		ids     []int
+	}{
+		{Where{Field: "Name", Prefix: "Jo"}, true, []int{members[0].ID, members[1].ID}},
+		{Where{Field: "Name", Suffix: "Jo"}, true, []int{members[3].ID}},
+		{Where{Field: "Name", Prefix: "J", Suffix: "n"}, true, []int{members[0].ID}},
+		{Where{Field: "Name", EqualFold: "JOHN"}, true, []int{members[0].ID}},
+		{Where{Field: "Email", Equals: "john@EXAMPLE.com"}, true, []int{members[0].ID}},
+		{Where{Field: "Email", In: []interface{}{"Jonas@Example.com", "MARY@example.com"}}, true, []int{members[2].ID, members[3].ID}},
+		{Where{Field: "Email", EqualFold: "Joanna@Example.Org"}, true, []int{members[1].ID}},
+		{Where{Field: "Email", Prefix: "JO"}, true, []int{members[0].ID, members[1].ID, members[2].ID}},
+		{Where{Field: "Email", Suffix: ".COM", And: &Where{Field: "Name", Prefix: "jo"}}, true, []int{members[2].ID}},
+		{Where{Field: "Email", Gte: "J", Lt: "K"}, true, []int{members[0].ID, members[1].ID, members[2].ID}},
+		{Where{Field: "Handle", Prefix: "@jo"}, false, []int{members[0].ID, members[1].ID, members[2].ID}},
+		{Where{Field: "Handle", EqualFold: "@MARY"}, false, []int{members[3].ID}},
+	}
+	for _, test := range tests {
+		q := dir.newQueryWithoutID("find all", &member{})
+		q.ReflectTypeOfResource()
+		indexed, _ := q.planWhere(test.where)
+		if (indexed != nil) != test.indexed {
+			t.Fatalf("Clause %+v answered from the index: %v, expected %v", test.where, indexed != nil, test.indexed)
+		}
+
+		serializedMembers := []member{}
+		err := dir.Find(&serializedMembers, test.where)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids(serializedMembers), test.ids) {
+			t.Fatalf("Found %v for %+v, expected %v", ids(serializedMembers), test.where, test.ids)
+		}
+	}
+
+	// Unique fields with the lower option are unique regardless of case.
+	err := dir.Create(&member{Name: "Johnny", Email: "JOHN@example.COM"})
+	violation := &ErrUniqueViolation{}
+	if !errors.As(err, &violation) || violation.ID != members[0].ID {
+		t.Fatal("Expected unique violation, got:", err)
+	}
+
+	// Staged writes of a transaction are matched the same way.
+	tx := dir.Begin()
+	staged := member{Name: "Joe", Email: "Joe@Example.com"}
+	err = tx.Create(&staged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serializedMembers := []member{}
+	err = tx.Find(&serializedMembers, Where{Field: "Email", Prefix: "JOE@"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids(serializedMembers), []int{staged.ID}) {
+		t.Fatalf("Found %v in transaction, expected %v", ids(serializedMembers), []int{staged.ID})
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dir.Find(&serializedMembers, Where{Field: "Age", Prefix: "4"})
+	if err == nil || errors.Is(err, ErrNoMatches) {
+		t.Fatal("Expected error for Prefix on an int field, got:", err)
+	}
+
+	afterEach()
+}
+
+func TestBooleanExpressions(t *testing.T) {
+	beforeEach()
+
+	subscribers := []subscriber{
+		{Status: "active", Plan: "pro"},
+		{Status: "trial", Plan: "free"},
+		{Status: "active", Banned: true, Plan: "free"},
+		{Status: "cancelled", Plan: "pro"},
+		{Status: "trial", Banned: true, Plan: "pro"},
+	}
+	for i := range subscribers {
+		err := dir.Create(&subscribers[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := func(indexes ...int) (ids []int) {
+		for _, i := range indexes {
+			ids = append(ids, subscribers[i].ID)
+		}
+		return
+	}
+
+	tests := []struct {
+		name    string
+		options []QueryOption
+		indexed bool
+		ids     []int
+	}{
+		{
+			"(active OR trial) AND NOT banned",
+			[]QueryOption{And(Or(Where{Field: "Status", Equals: "active"}, Where{Field: "Status", Equals: "trial"}), Not(Where{Field: "Banned", Equals: true}))},
+			true, ids(0, 1),
+		},
+		{
+			"NOT active",
+			[]QueryOption{Not(Where{Field: "Status", Equals: "active"})},
+			true, ids(1, 3, 4),
+		},
+		{
+			"NOT NOT banned",
+			[]QueryOption{Not(Not(Where{Field: "Banned", Equals: true}))},
+			true, ids(2, 4),
+		},
+		{
+			"active AND NOT pro, scanning the narrowed down candidates",
+			[]QueryOption{And(Where{Field: "Status", Equals: "active"}, Not(Where{Field: "Plan", Equals: "pro"}))},
+			true, ids(2),
+		},
+		{
+			"pro OR trial, scanning all resources",
+			[]QueryOption{Or(Where{Field: "Plan", Equals: "pro"}, Where{Field: "Status", Equals: "trial"})},
+			false, ids(0, 1, 3, 4),
+		},
+		{
+			"NOT pro, scanning all resources",
+			[]QueryOption{Not(Where{Field: "Plan", Equals: "pro"})},
+			false, ids(1, 2),
+		},
+		{
+			"expressions ORed with where clauses",
+			[]QueryOption{Where{Field: "Status", Equals: "cancelled"}, And(Where{Field: "Banned", Equals: true}, Not(Where{Field: "Status", Equals: "active"}))},
+			true, ids(3, 4),
+		},
+		{
+			"expressions ANDed with filters",
+			[]QueryOption{Not(Where{Field: "Banned", Equals: true}), Filter(func(resource interface{}) bool { return resource.(*subscriber).Plan == "pro" })},
+			true, ids(0, 3),
+		},
+	}
+	for _, test := range tests {
+		q := dir.newQueryWithoutID("find all", &subscriber{})
+		q.ReflectTypeOfResource()
+		q.ReflectModelNameFromType()
+		q.ApplyOptions(test.options)
+		_, indexed, err := q.exprIDs(q.expr())
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if indexed != test.indexed {
+			t.Fatalf("%s answered from the index: %v, expected %v", test.name, indexed, test.indexed)
+		}
+
+		serializedSubscribers := []subscriber{}
+		err = dir.Find(&serializedSubscribers, test.options...)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		found := []int{}
+		for _, s := range serializedSubscribers {
+			found = append(found, s.ID)
+		}
+		if !reflect.DeepEqual(found, test.ids) {
+			t.Fatalf("Found %v for %s, expected %v", found, test.name, test.ids)
+		}
+	}
+
+	// Staged writes of a transaction are matched against the expressions.
+	tx := dir.Begin()
+	staged := subscriber{Status: "trial", Plan: "free"}
+	err := tx.Create(&staged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribers[0].Banned = true
+	err = tx.Replace(&subscribers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	serializedSubscribers := []subscriber{}
+	err = tx.Find(&serializedSubscribers, And(Where{Field: "Status", In: []interface{}{"active", "trial"}}, Not(Where{Field: "Banned", Equals: true})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serializedSubscribers) != 2 || serializedSubscribers[0].ID != subscribers[1].ID || serializedSubscribers[1].ID != staged.ID {
+		t.Fatalf("Found wrong subscribers in transaction: %v", serializedSubscribers)
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dir.ReadAll(&serializedSubscribers, Not(Where{Field: "Banned", Equals: true}))
+	if err == nil {
+		t.Fatal("Expected error for expressions passed to ReadAll")
+	}
+	err = dir.Find(&serializedSubscribers, Not(Where{Field: "Tier", Equals: "gold"}))
+	if err == nil || errors.Is(err, ErrNoMatches) {
+		t.Fatal("Expected error for a field which does not exist, got:", err)
+	}
+
+	afterEach()
+}
+
+func TestCountAndAggregates(t *testing.T) {
+	beforeEach()
+
+	n, err := dir.Count(&product{})
+	if err != nil || n != 0 {
+		t.Fatal("Expected no products, got:", n, err)
+	}
+	_, err = dir.Min(&product{}, "Price")
+	if !errors.Is(err, ErrNoMatches) {
+		t.Fatal("Expected ErrNoMatches, got:", err)
+	}
+
+	for _, p := range []product{{Name: "pen", Price: 150}, {Name: "ink", Price: 450}, {Name: "pad", Price: 300}} {
+		err := dir.Create(&p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	members := []member{
+		{Name: "Ann", Email: "ann@example.com", Handle: "@ann", Age: 31},
+		{Name: "Bob", Email: "bob@example.com", Handle: "@bob", Age: 45},
+		{Name: "Bob", Email: "bob2@example.com", Handle: "@bob2", Age: 20},
+	}
+	for i := range members {
+		err := dir.Create(&members[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err = dir.Count(&product{})
+	if err != nil || n != 3 {
+		t.Fatal("Expected 3 products, got:", n, err)
+	}
+	n, err = dir.Count(&product{}, Where{Field: "Price", Gte: 300})
+	if err != nil || n != 2 {
+		t.Fatal("Expected 2 products costing 300 or more, got:", n, err)
+	}
+	n, err = dir.Count(&product{}, Where{Field: "Name", Equals: "eraser"})
+	if err != nil || n != 0 {
+		t.Fatal("Expected no erasers, got:", n, err)
+	}
+	exists, err := dir.Exists(&member{}, Where{Field: "Handle", Equals: "@bob2"})
+	if err != nil || !exists {
+		t.Fatal("Expected member @bob2 to exist, got:", exists, err)
+	}
+	exists, err = dir.Exists(&member{}, Not(Where{Field: "Name", In: []interface{}{"Ann", "Bob"}}))
+	if err != nil || exists {
+		t.Fatal("Expected no member other than Ann and Bob, got:", exists, err)
+	}
+
+	// Indexed fields are aggregated from the index, others from the decoded resources.
+	for _, test := range []struct {
+		resource  interface{}
+		field     string
+		options   []QueryOption
+		aggregate Aggregate
+	}{
+		{&product{}, "Price", nil, Aggregate{Count: 3, Sum: 900, Min: 150, Max: 450}},
+		{&product{}, "Price", []QueryOption{Where{Field: "Name", Prefix: "p"}}, Aggregate{Count: 2, Sum: 450, Min: 150, Max: 300}},
+		{&member{}, "Age", nil, Aggregate{Count: 3, Sum: 96, Min: 20, Max: 45}},
+		{&member{}, "Age", []QueryOption{Where{Field: "Name", Equals: "Bob"}}, Aggregate{Count: 2, Sum: 65, Min: 20, Max: 45}},
+	} {
+		a, err := dir.Aggregate(test.resource, test.field, test.options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a != test.aggregate {
+			t.Fatalf("Aggregated %+v for %T.%s, expected %+v", a, test.resource, test.field, test.aggregate)
+		}
+	}
+	sum, err := dir.Sum(&product{}, "Price")
+	if err != nil || sum != 900 {
+		t.Fatal("Expected sum 900, got:", sum, err)
+	}
+	min, err := dir.Min(&member{}, "Age")
+	if err != nil || min != 20 {
+		t.Fatal("Expected min 20, got:", min, err)
+	}
+	max, err := dir.Max(&product{}, "Price", Where{Field: "Name", Equals: "pad"})
+	if err != nil || max != 300 {
+		t.Fatal("Expected max 300, got:", max, err)
+	}
+	avg, err := dir.Avg(&member{}, "Age")
+	if err != nil || avg != 32 {
+		t.Fatal("Expected avg 32, got:", avg, err)
+	}
+
+	groups, err := dir.GroupBy(&member{}, "Name", "Age")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]Aggregate{
+		"Ann": {Count: 1, Sum: 31, Min: 31, Max: 31},
+		"Bob": {Count: 2, Sum: 65, Min: 20, Max: 45},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("Grouped %+v, expected %+v", groups, expected)
+	}
+	groups, err = dir.GroupBy(&member{}, "Email", "", Where{Field: "Age", Lt: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]Aggregate{"ann@example.com": {Count: 1}, "bob2@example.com": {Count: 1}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("Grouped %+v, expected %+v", groups, expected)
+	}
+
+	_, err = dir.Sum(&member{}, "Name")
+	if err == nil {
+		t.Fatal("Expected error aggregating a string field")
+	}
+	_, err = dir.Count(&member{}, Limit(1))
+	if err == nil {
+		t.Fatal("Expected error counting with Limit")
+	}
+	_, err = dir.Sum(&member{}, "Age", OrderBy("Age", Asc))
+	if err == nil {
+		t.Fatal("Expected error summing with OrderBy")
+	}
+	_, err = dir.GroupBy(&member{}, "Name", "Age", Offset(1))
+	if err == nil {
+		t.Fatal("Expected error grouping with Offset")
+	}
+
+	afterEach()
+}
+
+func TestExplainAndSlowQueries(t *testing.T) {
+	beforeEach()
+
+	for _, s := range []subscriber{
+		{Status: "active", Plan: "pro"},
+		{Status: "trial", Plan: "free"},
+		{Status: "active", Banned: true, Plan: "free"},
+	} {
+		err := dir.Create(&s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plan, err := dir.Explain(&subscriber{}, Where{Field: "Status", Equals: "active", And: &Where{Field: "Plan", Equals: "free"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ClausePlan{{
+		Clause:    "Status = active AND Plan = free",
+		Indexes:   []string{"hash:Status"},
+		Scan:      "Plan = free",
+		Estimated: 2,
+		Actual:    1,
+	}}
+	if !reflect.DeepEqual(plan.Clauses, expected) || plan.FullScan {
+		t.Fatalf("Explained %+v, expected %+v", plan.Clauses, expected)
+	}
+	if plan.Model != "gorialize.subscriber" || plan.Matched != 1 || plan.Returned != 1 || plan.Decoded != 3 || plan.Order != "id" {
+		t.Fatalf("Unexpected plan: %+v", plan)
+	}
+	if plan.DecodeTime <= 0 || plan.DecryptTime <= 0 || plan.ReadTime <= 0 || plan.Duration < plan.DecodeTime {
+		t.Fatalf("Timings missing from plan: %+v", plan)
+	}
+
+	plan, err = dir.Explain(&subscriber{}, Where{Field: "Plan", Equals: "pro"}, OrderBy("Status", Desc), Limit(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Clauses) != 1 || !plan.FullScan || !plan.Clauses[0].FullScan || plan.Clauses[0].Estimated != 3 || plan.Order != "index:Status" {
+		t.Fatalf("Expected full scan ordered by index, got: %+v", plan)
+	}
+
+	plan, err = dir.Explain(&subscriber{}, And(Or(Where{Field: "Status", Equals: "active"}, Where{Field: "Status", Equals: "trial"}), Not(Where{Field: "Banned", Equals: true})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Clauses) != 3 || plan.FullScan || plan.Matched != 2 || plan.Decoded != 2 {
+		t.Fatalf("Unexpected plan for expression: %+v", plan)
+	}
+	if describeExpr(And(Or(Where{Field: "Status", Equals: "active"}, Where{Field: "Status", Equals: "trial"}), Not(Where{Field: "Banned", Equals: true}))) != "(Status = active OR Status = trial) AND NOT Banned = true" {
+		t.Fatal("Expression described incorrectly")
+	}
+
+	plan, err = dir.Explain(&subscriber{}, Where{Field: "Status", Equals: "cancelled"})
+	if err != nil || plan.Matched != 0 {
+		t.Fatal("Expected plan without matches, got:", plan, err)
+	}
+
+	slow := []Plan{}
+	dir = NewDirectory(DirectoryConfig{
+		Path:               "/tmp/gorialize/gorialize_test",
+		Encrypted:          true,
+		Passphrase:         "password123",
+		SlowQueryThreshold: time.Nanosecond,
+		SlowQueryCallback:  func(plan Plan) { slow = append(slow, plan) },
+	})
+	serializedSubscribers := []subscriber{}
+	err = dir.Find(&serializedSubscribers, Where{Field: "Status", Equals: "trial"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dir.Count(&subscriber{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slow) != 2 || slow[0].Operation != "find all" || slow[0].Returned != 1 || slow[1].Operation != "count" || slow[1].Matched != 3 {
+		t.Fatalf("Slow queries not reported: %+v", slow)
+	}
+
+	afterEach()
+}
+
+func TestKeyDerivation(t *testing.T) {
+	path := "/tmp/gorialize/gorialize_test_kdf"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	open := func(path string, passphrase string, kdf string) (*Directory, error) {
+		return OpenDirectory(DirectoryConfig{Path: path, Encrypted: true, Passphrase: passphrase, KDF: kdf})
+	}
+
+	scryptDir, err := open(path+"/scrypt", "password123", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDir, err := open(path+"/other", "password123", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argonDir, err := open(path+"/argon2id", "password123", KDFArgon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *scryptDir.Key == *otherDir.Key || *scryptDir.Key == *legacyKey("password123") {
+		t.Fatal("Keys aren't derived with a per-directory salt")
+	}
+	for kdf, d := range map[string]*Directory{KDFScrypt: scryptDir, KDFArgon2id: argonDir} {
+		params, err := readKeyParams(d.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params.KDF != kdf || len(params.Salt) != 16 || params.Migrating {
+			t.Fatalf("Unexpected key parameters: %+v", params)
+		}
+		newUser := user{Name: "John Doe", Age: 42}
+		err = d.Create(&newUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reopened, err := open(d.Path, "password123", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *reopened.Key != *d.Key {
+			t.Fatalf("%s key not derived again from the stored parameters", kdf)
+		}
+		serializedUser := user{}
+		err = reopened.Read(&serializedUser, newUser.ID)
+		if err != nil || serializedUser != newUser {
+			t.Fatal("Resource not readable after reopening:", serializedUser, err)
+		}
+	}
+
+	// A directory written before keys were derived with a salt, which only
+	// encrypted resources, with the legacy key. Its migration is interrupted
+	// after the first resource has been re-encrypted.
+	legacyPath := path + "/legacy"
+	legacyDir, err := OpenDirectory(DirectoryConfig{Path: legacyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := []user{{Name: "John Doe", Age: 42}, {Name: "Jane Doe", Age: 41}, {Name: "Max Mustermann", Age: 40}}
+	for i := range users {
+		err = legacyDir.Create(&users[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		userPath := fmt.Sprintf("%s/gorialize.user/%07d", legacyPath, users[i].ID)
+		b, err := readFromDisk(userPath)
+		if err == nil {
+			b, err = encrypt(legacyKey("password123"), b, nil)
+		}
+		if err == nil {
+			err = writeToDisk(userPath, b)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = open(legacyPath, "wrong-password", "")
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatal("Expected ErrDecrypt migrating with the wrong passphrase, got:", err)
+	}
+	_, err = readKeyParams(legacyPath)
+	if !os.IsNotExist(err) {
+		t.Fatal("Key parameters written for the wrong passphrase:", err)
+	}
+	params, err := newKeyParams(KDFScrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.Migrating = true
+	err = writeKeyParams(legacyPath, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := params.deriveKey("password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstPath := fmt.Sprintf("%s/gorialize.user/%07d", legacyPath, users[0].ID)
+	b, err := readFromDisk(firstPath)
+	if err == nil {
+		b, err = decrypt(legacyKey("password123"), b, nil)
+	}
+	if err == nil {
+		b, err = sealResource(key, 0, "gorialize.user", users[0].ID, b)
+	}
+	if err == nil {
+		err = writeToDisk(firstPath, b)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migratedDir, err := open(legacyPath, "password123", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *migratedDir.Key != *key {
+		t.Fatal("Migration didn't keep the recorded salt")
+	}
+	serializedUsers := []user{}
+	err = migratedDir.ReadAll(&serializedUsers)
+	if err != nil || !reflect.DeepEqual(serializedUsers, users) {
+		t.Fatal("Resources not readable after migration:", serializedUsers, err)
+	}
+	legacyDir.Encrypted = true
+	legacyDir.Key = legacyKey("password123")
+	err = legacyDir.Read(&user{}, users[1].ID)
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatal("Resource still encrypted with the legacy key:", err)
+	}
+	params, err = readKeyParams(legacyPath)
+	if err != nil || params.Migrating {
+		t.Fatal("Migration not completed:", params, err)
+	}
+
+	// A plaintext directory opened with encryption by mistake is left as is.
+	plainPath := path + "/plain"
+	plainDir, err := OpenDirectory(DirectoryConfig{Path: plainPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainUser := user{Name: "John Doe", Age: 42}
+	err = plainDir.Create(&plainUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = open(plainPath, "password123", "")
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatal("Expected ErrDecrypt opening a plaintext directory with encryption, got:", err)
+	}
+	_, err = readKeyParams(plainPath)
+	if !os.IsNotExist(err) {
+		t.Fatal("Key parameters written for a plaintext directory:", err)
+	}
+	plainDir, err = OpenDirectory(DirectoryConfig{Path: plainPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serializedUser := user{}
+	err = plainDir.Read(&serializedUser, plainUser.ID)
+	if err != nil || serializedUser != plainUser {
+		t.Fatal("Plaintext directory not readable anymore:", serializedUser, err)
+	}
+}
+
+func TestEncryptedMetadata(t *testing.T) {
+	path := "/tmp/gorialize/gorialize_test_sealed"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+
+	// leaks returns the files below path whose name or content contains any
+	// of the given strings.
+	leaks := func(path string, secrets ...string) []string {
+		leaked := []string{}
+		err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			b := []byte{}
+			if !info.IsDir() {
+				b, err = ioutil.ReadFile(p)
+				if err != nil {
+					return err
+				}
+			}
+			for _, s := range secrets {
+				if strings.Contains(p[len(path):], s) || bytes.Contains(b, []byte(s)) {
+					leaked = append(leaked, p)
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaked
+	}
+	check := func(d *Directory, expectedCount int) {
+		users := []userV3{}
+		err := d.Find(&users, Where{Field: "Name", Equals: "John Doe"})
+		if err != nil || len(users) != 1 || users[0].Age != 42 {
+			t.Fatal("Indexed resource not found:", users, err)
+		}
+		n, err := d.Count(&userV3{})
+		if err != nil || n != expectedCount {
+			t.Fatalf("Counted %d resources, expected %d: %v", n, expectedCount, err)
+		}
+	}
+
+	config := DirectoryConfig{
+		Path:                path + "/obfuscated",
+		Encrypted:           true,
+		Passphrase:          "password123",
+		ObfuscateModelNames: true,
+	}
+	obfuscatedDir, err := OpenDirectory(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []userV3{{Name: "John Doe", Age: 42}, {Name: "Jane Doe", Age: 41}} {
+		err = obfuscatedDir.Create(&u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx := obfuscatedDir.Begin()
+	err = tx.Create(&userV3{Name: "Max Doe", Age: 40})
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaked := leaks(config.Path, "gorialize.", "Name", "John Doe"); len(leaked) > 0 {
+		t.Fatal("Plaintext left in encrypted directory:", leaked)
+	}
+	config.ObfuscateModelNames = false
+	obfuscatedDir, err = OpenDirectory(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(obfuscatedDir, 3)
+	err = obfuscatedDir.CompactIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	obfuscatedDir, err = OpenDirectory(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(obfuscatedDir, 3)
+	if leaked := leaks(config.Path, "gorialize.", "Name", "John Doe"); len(leaked) > 0 {
+		t.Fatal("Plaintext left in compacted index:", leaked)
+	}
+	model, _, err := obfuscatedDir.readSchema(config.Path + "/" + obfuscatedDir.modelDirName("gorialize.userV3") + "/metadata")
+	if err != nil || model != "gorialize.userV3" {
+		t.Fatal("Model name not recovered from schema:", model, err)
+	}
+
+	_, err = OpenDirectory(DirectoryConfig{Path: path + "/plain", ObfuscateModelNames: true})
+	if err == nil {
+		t.Fatal("Expected error obfuscating model names without encryption")
+	}
+
+	// A directory whose resources were encrypted with a salted key before the
+	// index log, counters and schemas were.
+	unsealedPath := path + "/unsealed"
+	unsealedDir, err := OpenDirectory(DirectoryConfig{Path: unsealedPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := newKeyParams(KDFScrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := params.deriveKey("password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []userV3{{Name: "John Doe", Age: 42}, {Name: "Jane Doe", Age: 41}} {
+		err = unsealedDir.Create(&u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		userPath := fmt.Sprintf("%s/gorialize.userV3/%07d", unsealedPath, u.ID)
+		b, err := readFromDisk(userPath)
+		if err == nil {
+			b, err = encrypt(key, b, nil)
+		}
+		if err == nil {
+			err = writeToDisk(userPath, b)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = writeKeyParams(unsealedPath, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedDir, err := OpenDirectory(DirectoryConfig{Path: unsealedPath, Encrypted: true, Passphrase: "password123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(sealedDir, 2)
+	err = sealedDir.Create(&userV3{Name: "Max Doe", Age: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaked := leaks(unsealedPath, "Name", "John Doe"); len(leaked) > 0 {
+		t.Fatal("Plaintext left after migration:", leaked)
+	}
+	params, err = readKeyParams(unsealedPath)
+	if err != nil || !params.Sealed || len(params.Check) == 0 || params.ObfuscateModels {
+		t.Fatal("Migration not recorded:", params, err)
+	}
+
+	// Plaintext metadata planted in the sealed directory is rejected.
+	counterPath := unsealedPath + "/gorialize.userV3/metadata/counter"
+	counter, err := readFromDisk(counterPath)
+	if err == nil {
+		err = writeToDisk(counterPath, []byte("0"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sealedDir.Create(&userV3{Name: "Mallory", Age: 30})
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatal("Expected ErrDecrypt with a plaintext counter, got:", err)
+	}
+	err = writeToDisk(counterPath, counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(sealedDir, 3)
+	err = appendToDisk(sealedDir.IndexLogPath, []byte("gorialize.userV3:Name:Mallory:1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenDirectory(DirectoryConfig{Path: unsealedPath, Encrypted: true, Passphrase: "password123"})
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatal("Expected ErrDecrypt with a plaintext index log line, got:", err)
+	}
+}
+
+func TestTamperedResources(t *testing.T) {
+	beforeEach()
+
+	users := []user{{Name: "John Doe", Age: 42}, {Name: "Jane Doe", Age: 41}}
+	for i := range users {
+		err := dir.Create(&users[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := func(model string, id int) string {
+		return fmt.Sprintf("%s/%s/%07d", dir.Path, model, id)
+	}
+	first, err := readFromDisk(path("gorialize.user", users[0].ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := readFromDisk(path("gorialize.user", users[1].ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(first, resourceHeader(0)) {
+		t.Fatal("Resource written without header")
+	}
+
+	// Swapped resources
+	err = writeToDisk(path("gorialize.user", users[0].ID), second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dir.Read(&user{}, users[0].ID)
+	if !errors.Is(err, ErrTampered) || !errors.Is(err, ErrDecrypt) {
+		t.Fatal("Expected ErrTampered reading swapped resource, got:", err)
+	}
+
+	// Resource moved to another model
+	err = os.MkdirAll(dir.Path+"/gorialize.userV3", os.ModePerm)
+	if err == nil {
+		err = writeToDisk(path("gorialize.userV3", users[1].ID), second)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dir.Read(&userV3{}, users[1].ID)
+	if !errors.Is(err, ErrTampered) {
+		t.Fatal("Expected ErrTampered reading moved resource, got:", err)
+	}
+
+	// Resources encrypted without header stay readable.
+	plaintext, err := dir.openResource("gorialize.user", users[1].ID, second)
+	if err == nil {
+		first, err = encrypt(dir.Key, plaintext, nil)
+	}
+	if err == nil {
+		err = writeToDisk(path("gorialize.user", users[0].ID), first)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	serializedUser := user{}
+	err = dir.Read(&serializedUser, users[0].ID)
+	if err != nil || serializedUser != users[1] {
+		t.Fatal("Legacy resource not readable:", serializedUser, err)
+	}
+
+	// Resources without header are bound to their model and ID when the
+	// directory is opened, so swapping them is caught afterwards.
+	err = os.Remove(path("gorialize.userV3", users[1].ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range users {
+		var buf bytes.Buffer
+		err = gob.NewEncoder(&buf).Encode(&users[i])
+		var b []byte
+		if err == nil {
+			b, err = encrypt(dir.Key, buf.Bytes(), nil)
+		}
+		if err == nil {
+			err = writeToDisk(path("gorialize.user", users[i].ID), b)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	params, err := readKeyParams(dir.Path)
+	if err == nil {
+		params.Bound = false
+		err = writeKeyParams(dir.Path, params)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	boundDir, err := OpenDirectory(DirectoryConfig{Path: dir.Path, Encrypted: true, Passphrase: "password123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err = readFromDisk(path("gorialize.user", users[0].ID))
+	if err == nil {
+		second, err = readFromDisk(path("gorialize.user", users[1].ID))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(first, resourceHeader(0)) || !bytes.HasPrefix(second, resourceHeader(0)) {
+		t.Fatal("Resources without header not re-encrypted with it")
+	}
+	params, err = readKeyParams(dir.Path)
+	if err != nil || !params.Bound {
+		t.Fatal("Binding not recorded:", params, err)
+	}
+	err = writeToDisk(path("gorialize.user", users[0].ID), second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = boundDir.Read(&user{}, users[0].ID)
+	if !errors.Is(err, ErrTampered) {
+		t.Fatal("Expected ErrTampered reading swapped legacy resource, got:", err)
+	}
+
+	afterEach()
+}
+
+func TestRekey(t *testing.T) {
+	path := "/tmp/gorialize/gorialize_test_rekey"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+
+	open := func(passphrase string) *Directory {
+		d, err := OpenDirectory(DirectoryConfig{Path: path, Encrypted: passphrase != "", Passphrase: passphrase})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	check := func(d *Directory, expectedCount int) {
+		users := []userV3{}
+		err := d.Find(&users, Where{Field: "Name", Equals: "John Doe"})
+		if err != nil || len(users) != 1 || users[0].Age != 42 {
+			t.Fatal("Indexed resource not found:", users, err)
+		}
+		users = []userV3{}
+		err = d.ReadAll(&users)
+		if err != nil || len(users) != expectedCount {
+			t.Fatalf("Read %d resources, expected %d: %v", len(users), expectedCount, err)
+		}
+	}
+	keyIDs := func() map[uint32]int {
+		ids := map[uint32]int{}
+		files, err := filepath.Glob(path + "/gorialize.userV3/[0-9]*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			b, err := readFromDisk(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			header, keyID := parseResourceHeader(b)
+			if header == nil {
+				t.Fatal("Resource without header:", f)
+			}
+			ids[keyID]++
+		}
+		return ids
+	}
+
+	plainDir := open("")
+	for _, u := range []userV3{{Name: "John Doe", Age: 42}, {Name: "Jane Doe", Age: 41}, {Name: "Max Doe", Age: 40}} {
+		err := plainDir.Create(&u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Encrypting a plaintext directory
+	reported := []RekeyProgress{}
+	err := plainDir.Rekey("first", func(p RekeyProgress) {
+		reported = append(reported, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 3 || reported[2] != (RekeyProgress{Model: "gorialize.userV3", Done: 3, Total: 3}) {
+		t.Fatal("Unexpected progress:", reported)
+	}
+	check(plainDir, 3)
+	encrypted := false
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			var b []byte
+			b, err = ioutil.ReadFile(p)
+			encrypted = encrypted || bytes.Contains(b, []byte("Jane Doe"))
+		}
+		return err
+	})
+	if err != nil || encrypted {
+		t.Fatal("Plaintext left in encrypted directory:", err)
+	}
+	check(open("first"), 3)
+
+	// Rotating the key
+	d := open("first")
+	firstKey := d.Key
+	err = d.Rekey("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(d, 3)
+	_, err = OpenDirectory(DirectoryConfig{Path: path, Encrypted: true, Passphrase: "first"})
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatal("Expected ErrDecrypt opening with the previous passphrase, got:", err)
+	}
+	if ids := keyIDs(); ids[1] != 3 {
+		t.Fatal("Resources not re-encrypted with the new key:", ids)
+	}
+
+	// A resource written with the previous key by a process which hasn't
+	// reopened the directory yet stays readable until the key is pruned.
+	users := []userV3{}
+	err = d.ReadAll(&users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := users[2]
+	stale.Age = 30
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(&stale)
+	b := []byte{}
+	if err == nil {
+		b, err = sealResource(firstKey, 0, "gorialize.userV3", stale.ID, buf.Bytes())
+	}
+	if err == nil {
+		err = writeToDisk(fmt.Sprintf("%s/gorialize.userV3/%07d", path, stale.ID), b)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = open("second")
+	serializedUser := userV3{}
+	err = d.Read(&serializedUser, stale.ID)
+	if err != nil || serializedUser != stale {
+		t.Fatal("Resource of the previous key not readable after rekeying:", serializedUser, err)
+	}
+	err = d.PruneKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := readKeyParams(path)
+	if err != nil || len(params.Keyring) > 0 {
+		t.Fatal("Keyring not dropped by PruneKeys:", params, err)
+	}
+	if ids := keyIDs(); ids[1] != 3 {
+		t.Fatal("Resources not re-encrypted by PruneKeys:", ids)
+	}
+	serializedUser = userV3{}
+	err = open("second").Read(&serializedUser, stale.ID)
+	if err != nil || serializedUser != stale {
+		t.Fatal("Resource not readable after pruning:", serializedUser, err)
+	}
+
+	// Interrupted after recording the new key: resources of both keys are
+	// read until Rekey is resumed.
+	d = open("second")
+	params, err = readKeyParams(path)
+	if err == nil {
+		_, err = d.startRekey(params, &KeyMaterial{Passphrase: "third"})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = open("third")
+	err = d.Create(&userV3{Name: "Jim Doe", Age: 39})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(d, 4)
+	if ids := keyIDs(); ids[1] != 3 || ids[2] != 1 {
+		t.Fatal("Unexpected key IDs of resources:", ids)
+	}
+	err = d.Rekey("third")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := keyIDs(); ids[2] != 4 {
+		t.Fatal("Resources not re-encrypted when resuming:", ids)
+	}
+	params, err = readKeyParams(path)
+	if err != nil || params.Rekeying != "" || len(params.Keyring) != 1 {
+		t.Fatal("Previous keys not kept after rekeying:", params, err)
+	}
+	check(open("third"), 4)
+
+	// The CLI only decrypts if asked to.
+	err = Rekey(path, StaticPassphrase("third"), nil, false)
+	if err == nil {
+		t.Fatal("Expected error rekeying without a new key")
+	}
+	if _, err := os.Stat(keyParamsPath(path)); err != nil {
+		t.Fatal("Directory decrypted without --decrypt:", err)
+	}
+	check(open("third"), 4)
+
+	// Decrypting
+	d = open("third")
+	err = d.Rekey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(d, 4)
+	if _, err := os.Stat(keyParamsPath(path)); !os.IsNotExist(err) {
+		t.Fatal("Key parameters left in decrypted directory:", err)
+	}
+	check(open(""), 4)
+
+	// Tampered resources are rejected while an interrupted Rekey encrypts
+	// the directory, whose resources are in plaintext until then.
+	d = open("")
+	_, err = d.startRekey(nil, &KeyMaterial{Passphrase: "fourth"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = open("fourth")
+	check(d, 4)
+	users = []userV3{}
+	err = d.ReadAll(&users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swappedPath := fmt.Sprintf("%s/gorialize.userV3/%07d", path, users[1].ID)
+	original, err := readFromDisk(swappedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	err = gob.NewEncoder(&buf).Encode(&users[0])
+	if err == nil {
+		b, err = sealResource(d.Key, d.keyID, "gorialize.userV3", users[0].ID, buf.Bytes())
+	}
+	if err == nil {
+		err = writeToDisk(swappedPath, b)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Read(&userV3{}, users[1].ID)
+	if !errors.Is(err, ErrTampered) {
+		t.Fatal("Expected ErrTampered reading swapped resource while encrypting, got:", err)
+	}
+	err = writeToDisk(swappedPath, append(resourceHeader(7), b[len(resourceHeader(d.keyID)):]...))
+	if err == nil {
+		err = d.Rekey("fourth")
+	}
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatal("Expected ErrDecrypt rekeying resource of an unknown key, got:", err)
+	}
+	err = writeToDisk(swappedPath, original)
+	if err == nil {
+		err = d.Rekey("fourth")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(open("fourth"), 4)
+
+	// Obfuscated model names can't be restored.
+	obfuscatedDir, err := OpenDirectory(DirectoryConfig{
+		Path:                path + "/obfuscated",
+		Encrypted:           true,
+		Passphrase:          "password123",
+		ObfuscateModelNames: true,
+	})
+	if err == nil {
+		err = obfuscatedDir.Create(&userV3{Name: "John Doe", Age: 42})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = obfuscatedDir.Rekey("")
+	if err == nil {
+		t.Fatal("Expected error decrypting directory with obfuscated model names")
+	}
+	err = obfuscatedDir.Rekey("password456")
+	if err == nil {
+		check(obfuscatedDir, 1)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Models created in a transaction are rekeyed under their model name,
+	// and Rekey fails before recording a new key if a model name can't be
+	// recovered.
+	tx := obfuscatedDir.Begin()
+	err = tx.Create(&todoList{Title: "Groceries"})
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err == nil {
+		err = obfuscatedDir.Rekey("password789")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemaPath := path + "/obfuscated/" + obfuscatedDir.modelDirName("gorialize.todoList") + "/metadata/schema"
+	err = os.Remove(schemaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = obfuscatedDir.Rekey("password000")
+	if err == nil {
+		t.Fatal("Expected error rekeying a model without schema")
+	}
+	params, err = readKeyParams(path + "/obfuscated")
+	if err != nil || params.Rekeying != "" || !bytes.Equal(params.Check, keyCheck(obfuscatedDir.Key)) {
+		t.Fatal("Key parameters changed by failed Rekey:", params, err)
+	}
+	check(obfuscatedDir, 1)
+}
+
+func TestKeyProviders(t *testing.T) {
+	path := "/tmp/gorialize/gorialize_test_keys"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	err := os.MkdirAll(path, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	open := func(dirPath string, keys KeyProvider) (*Directory, error) {
+		return OpenDirectory(DirectoryConfig{Path: dirPath, KeyProvider: keys})
+	}
+	check := func(d *Directory) {
+		u := userV3{}
+		err := d.Read(&u, 1)
+		if err != nil || u.Name != "John Doe" {
+			t.Fatal("Resource not read:", u, err)
+		}
+	}
+
+	// Raw key file
+	var key [32]byte
+	_, err = rand.Read(key[:])
+	if err == nil {
+		err = ioutil.WriteFile(path+"/key", key[:], 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := open(path+"/raw", KeyFile(path+"/key"))
+	if err == nil {
+		err = d.Create(&userV3{Name: "John Doe", Age: 42})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Encrypted {
+		t.Fatal("Directory with key provider not encrypted")
+	}
+	d, err = open(path+"/raw", StaticKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(d)
+	key[0]++
+	_, err = open(path+"/raw", StaticKey(key))
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatal("Expected ErrDecrypt opening with another key, got:", err)
+	}
+	_, err = open(path+"/raw", StaticPassphrase("password123"))
+	if err == nil {
+		t.Fatal("Expected error opening directory with raw key with a passphrase")
+	}
+	err = ioutil.WriteFile(path+"/short", key[:16], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = open(path+"/raw", KeyFile(path+"/short"))
+	if err == nil {
+		t.Fatal("Expected error reading key file of 16 bytes")
+	}
+
+	// Passphrase providers derive the same key as DirectoryConfig.Passphrase.
+	d, err = OpenDirectory(DirectoryConfig{Path: path + "/pass", Encrypted: true, Passphrase: "password123"})
+	if err == nil {
+		err = d.Create(&userV3{Name: "John Doe", Age: 42})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GORIALIZE_TEST_PASS", "password123")
+	defer os.Unsetenv("GORIALIZE_TEST_PASS")
+	for _, keys := range []KeyProvider{
+		EnvPassphrase("GORIALIZE_TEST_PASS"),
+		CommandPassphrase("echo", "password123"),
+		StaticPassphrase("password123"),
+	} {
+		d, err = open(path+"/pass", keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(d)
+	}
+	for _, keys := range []KeyProvider{
+		EnvPassphrase("GORIALIZE_TEST_UNSET"),
+		CommandPassphrase("false"),
+		CommandPassphrase("true"),
+	} {
+		_, err = open(path+"/pass", keys)
+		if err == nil {
+			t.Fatal("Expected error from key provider", keys)
+		}
+	}
+
+	// Switching from a passphrase to a raw key
+	err = d.RekeyWith(KeyFile(path + "/key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = open(path+"/pass", StaticPassphrase("password123"))
+	if err == nil {
+		t.Fatal("Expected error opening rekeyed directory with the previous passphrase")
+	}
+	d, err = open(path+"/pass", KeyFile(path+"/key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(d)
+}
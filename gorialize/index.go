@@ -2,42 +2,133 @@
 package gorialize
 
 import (
-	"fmt"
 	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 )
 
+// Index maps indexed field values to resource IDs (KV) and resource fields to
+// their index keys (VK). The mutex guards both maps since they are shared by all
+// models of a directory. Sorted indexes for range queries are built on demand.
 type Index struct {
-	KV map[string][]int
-	VK map[string][]string
+	KV          map[string][]int
+	VK          map[string][]string
+	mutex       *sync.RWMutex
+	sorted      map[string]*sortedIndex
+	sortedMutex *sync.Mutex
 }
 
 func NewIndex() Index {
 	return Index{
-		KV: map[string][]int{},
-		VK: map[string][]string{},
+		KV:          map[string][]int{},
+		VK:          map[string][]string{},
+		mutex:       &sync.RWMutex{},
+		sorted:      map[string]*sortedIndex{},
+		sortedMutex: &sync.Mutex{},
+	}
+}
+
+// clear removes all entries from the index.
+func (idx Index) clear() {
+	for key := range idx.KV {
+		delete(idx.KV, key)
+	}
+	for val := range idx.VK {
+		delete(idx.VK, val)
+	}
+	idx.dropSorted("")
+}
+
+// removeModel removes all entries of a model from the index.
+func (idx Index) removeModel(model string) {
+	prefix := model + ":"
+	for key := range idx.KV {
+		if strings.HasPrefix(key, prefix) {
+			delete(idx.KV, key)
+		}
 	}
+	for val := range idx.VK {
+		if strings.HasPrefix(val, prefix) {
+			delete(idx.VK, val)
+		}
+	}
+	idx.dropSorted(prefix)
 }
 
+// dropSorted drops the sorted indexes whose names start with prefix.
+func (idx Index) dropSorted(prefix string) {
+	idx.sortedMutex.Lock()
+	defer idx.sortedMutex.Unlock()
+
+	for name := range idx.sorted {
+		if strings.HasPrefix(name, prefix) {
+			delete(idx.sorted, name)
+		}
+	}
+}
+
+// getIDs returns the IDs of the resources whose field has the value. The
+// value must have the type of the field.
 func (idx Index) getIDs(model string, field string, value interface{}) []int {
-	key := makeKey(model, field, value)
-	return idx.KV[key]
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	key := makeKey(model, field, indexValue(reflect.ValueOf(value)))
+	return append([]int(nil), idx.KV[key]...)
 }
 
-func (idx Index) getMatchingIDs(model string, clauses ...Where) (ids []int) {
+func (idx Index) getMatchingIDs(model string, resourceType reflect.Type, clauses ...Where) ([]int, error) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	return idx.matchingIDs(model, resourceType, clauses...)
+}
+
+func (idx Index) matchingIDs(model string, resourceType reflect.Type, clauses ...Where) (ids []int, err error) {
 	idMap := map[int]bool{}
 	for _, clause := range clauses {
 		var tmpIDs []int
 		switch true {
+		case clause.Match != "":
+			scores, err := idx.matchScores(model, resourceType, clause.Field, clause.Match)
+			if err != nil {
+				return nil, err
+			}
+			for id := range scores {
+				tmpIDs = append(tmpIDs, id)
+			}
+		case clause.isStringMatch():
+			tmpIDs, err = idx.stringIDs(model, resourceType, clause)
+			if err != nil {
+				return nil, err
+			}
+		case clause.isRange():
+			tmpIDs, err = idx.rangeIDs(model, resourceType, clause)
+			if err != nil {
+				return nil, err
+			}
 		case len(clause.Range) > 0:
 			for _, value := range clause.Range {
-				tmpIDs = append(tmpIDs, idx.getIDs(model, clause.Field, value)...)
+				tmpIDs, err = idx.appendIDs(tmpIDs, model, resourceType, clause.Field, value)
+				if err != nil {
+					return nil, err
+				}
 			}
 		case len(clause.In) > 0:
 			for _, value := range clause.In {
-				tmpIDs = append(tmpIDs, idx.getIDs(model, clause.Field, value)...)
+				tmpIDs, err = idx.appendIDs(tmpIDs, model, resourceType, clause.Field, value)
+				if err != nil {
+					return nil, err
+				}
 			}
 		default:
-			tmpIDs = idx.getIDs(model, clause.Field, clause.Equals)
+			tmpIDs, err = idx.appendIDs(nil, model, resourceType, clause.Field, clause.Equals)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		if clause.And == nil {
@@ -45,16 +136,17 @@ func (idx Index) getMatchingIDs(model string, clauses ...Where) (ids []int) {
 				idMap[id] = true
 			}
 		} else {
-			tmpIDmap := map[int]int{}
+			// fields with several values may match the same ID more than once
+			tmpIDmap := map[int]bool{}
 			for _, id := range tmpIDs {
-				tmpIDmap[id]++
+				tmpIDmap[id] = true
 			}
-			idsToAnd := idx.getMatchingIDs(model, *clause.And)
-			for _, id := range idsToAnd {
-				tmpIDmap[id]++
+			idsToAnd, err := idx.matchingIDs(model, resourceType, *clause.And)
+			if err != nil {
+				return nil, err
 			}
-			for id, cnt := range tmpIDmap {
-				if cnt > 1 {
+			for _, id := range idsToAnd {
+				if tmpIDmap[id] {
 					idMap[id] = true
 				}
 			}
@@ -66,11 +158,230 @@ func (idx Index) getMatchingIDs(model string, clauses ...Where) (ids []int) {
 	return
 }
 
+// appendIDs appends the IDs of the resources whose field has the value,
+// converted to the field's type, to ids.
+func (idx Index) appendIDs(ids []int, model string, resourceType reflect.Type, field string, value interface{}) ([]int, error) {
+	key, err := fieldIndexKey(model, resourceType, field, value)
+	if err != nil {
+		return nil, err
+	}
+	return append(ids, idx.KV[key]...), nil
+}
+
+// rangeIDs returns the IDs matching the clause's comparison operators using
+// the sorted index of the clause's field.
+func (idx Index) rangeIDs(model string, resourceType reflect.Type, clause Where) ([]int, error) {
+	fp, err := lookupField(resourceType, clause.Field)
+	if err != nil {
+		return nil, err
+	}
+	clause = clause.normalizedFor(fp)
+	kind, err := fieldOrderKind(resourceType, clause.Field)
+	if err != nil {
+		return nil, err
+	}
+	b, err := clause.bounds(kind)
+	if err != nil {
+		return nil, err
+	}
+	si, err := idx.sortedIndexFor(model, fp.name, kind)
+	if err != nil {
+		return nil, err
+	}
+	return si.ids(b), nil
+}
+
+// fieldTag holds the options of a field's `gorialize` struct tag, e.g.
+// `gorialize:"indexed,unique"`, `gorialize:"index:tenant_status"` or
+// `gorialize:"fulltext"`. Indexed string fields with the lower option are
+// indexed and compared in lower case.
+type fieldTag struct {
+	indexed    bool
+	unique     bool
+	lower      bool
+	fulltext   bool
+	composites []string
+}
+
+func parseFieldTag(field reflect.StructField) (tag fieldTag) {
+	for _, option := range strings.Split(field.Tag.Get("gorialize"), ",") {
+		option = strings.TrimSpace(option)
+		switch {
+		case option == "indexed":
+			tag.indexed = true
+		case option == "unique":
+			tag.indexed = true
+			tag.unique = true
+		case option == "lower":
+			tag.lower = true
+		case option == "fulltext":
+			tag.fulltext = true
+		case strings.HasPrefix(option, "index:") && len(option) > len("index:"):
+			tag.composites = append(tag.composites, option[len("index:"):])
+		}
+	}
+	return
+}
+
+// isIndexedField reports whether a resource type's field is tagged as indexed.
+func isIndexedField(resourceType reflect.Type, field string) bool {
+	fp, err := lookupField(resourceType, field)
+	return err == nil && fp.tag.indexed
+}
+
+// indexLogEntries returns the index log entries for the indexed fields of a
+// resource based on operator: '+' = add, '-' = remove, 'x' = replace
+// Fields with several values get an entry for each distinct value and
+// fulltext fields an entry for each distinct token.
+func indexLogEntries(model string, resourceType reflect.Type, resource interface{}, id int, operator rune) (logEntries []string) {
+	for _, fp := range indexedFields(resourceType) {
+		if fp.tag.fulltext {
+			if operator == '-' || operator == 'x' {
+				logEntries = append(logEntries, "-"+makeVal(model, fulltextField(fp.name), id))
+			}
+			if operator == '+' || operator == 'x' {
+				values := fp.values(reflect.Indirect(reflect.ValueOf(resource)))
+				logEntries = append(logEntries, fulltextLogEntries(model, fp.name, values, id)...)
+			}
+		}
+		if !fp.tag.indexed {
+			continue
+		}
+		if operator == '-' || operator == 'x' {
+			logEntries = append(logEntries, "-"+makeVal(model, fp.name, id))
+		}
+		if operator == '+' || operator == 'x' {
+			seen := map[string]bool{}
+			for _, value := range fp.values(reflect.Indirect(reflect.ValueOf(resource))) {
+				key := makeKey(model, fp.name, fp.indexValue(value))
+				if !seen[key] {
+					seen[key] = true
+					logEntries = append(logEntries, fmt.Sprintf("+%s=%d", key, id))
+				}
+			}
+		}
+	}
+	for _, composite := range compositeIndexes(resourceType) {
+		if operator == '-' || operator == 'x' {
+			logEntries = append(logEntries, "-"+makeVal(model, composite.field(), id))
+		}
+		if operator == '+' || operator == 'x' {
+			value := compositeResourceValue(resourceType, composite, resource)
+			logEntries = append(logEntries, fmt.Sprintf("+%s=%d", makeKey(model, composite.field(), value), id))
+		}
+	}
+	return
+}
+
+// applyLogEntry applies a single index log entry, i.e. "+model:field:value=id"
+// or "-model:field:id", to the index.
+func (idx Index) applyLogEntry(logEntry string) error {
+	if len(logEntry) < 4 {
+		return errors.New("Invalid index log entry")
+	}
+	var id []byte
+	var key string
+	for i := len(logEntry) - 1; i >= 0; i-- {
+		if logEntry[i] == '=' || logEntry[i] == ':' {
+			key = logEntry[1:i]
+			break
+		} else {
+			id = append([]byte{logEntry[i]}, id...)
+		}
+	}
+	ID, err := strconv.Atoi(string(id))
+	if err != nil {
+		return errors.New("Invalid index log entry")
+	}
+	switch logEntry[0] {
+	case '+':
+		return idx.addDirectly(key, ID)
+	case '-':
+		idx.removeDirectly(logEntry[1:], ID)
+		return nil
+	default:
+		return errors.New("Invalid index log entry")
+	}
+}
+
+// matchesWhere reports whether a resource matches any of the clauses. Fields
+// are compared the same way Index.matchingIDs would if they were indexed.
+func matchesWhere(model string, resource interface{}, clauses ...Where) bool {
+	val := reflect.Indirect(reflect.ValueOf(resource))
+	for _, clause := range clauses {
+		matched := clause.Field == "" || matchesField(model, val, clause)
+		if matched && clause.Filter != nil {
+			matched = clause.Filter(resource)
+		}
+		if matched && (clause.And == nil || matchesWhere(model, resource, *clause.And)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesField reports whether the clause's field of a resource's value
+// matches the clause, ignoring Filter and And. Query values which can't be
+// converted to the field's type don't match.
+func matchesField(model string, val reflect.Value, clause Where) bool {
+	fp, err := lookupField(reflect.PtrTo(val.Type()), clause.Field)
+	if err != nil {
+		return false
+	}
+	if clause.Match != "" {
+		groups, err := parseMatch(clause.Match)
+		return err == nil && matchesText(groups, textTokens(fp.values(val)))
+	}
+	clause = clause.normalizedFor(fp)
+	for _, value := range fp.values(val) {
+		if matchesValue(fp, value, clause) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesValue reports whether one of a field's values matches the clause.
+func matchesValue(fp fieldPath, value reflect.Value, clause Where) bool {
+	encoded := fp.indexValue(value)
+	equals := func(queryValue interface{}) bool {
+		encodedQueryValue, err := fp.encodeValue(queryValue)
+		return err == nil && encoded == encodedQueryValue
+	}
+
+	matched := false
+	switch true {
+	case clause.isStringMatch():
+		matched = clause.matchesString(fp.normalize(formatIndexValue(value)))
+	case clause.isRange():
+		kind := orderKindOf(fp.typ)
+		b, err := clause.bounds(kind)
+		if err != nil {
+			break
+		}
+		ordered := value.Interface()
+		if fp.lowered() {
+			ordered = fp.normalize(value.String())
+		}
+		v, err := toOrdered(kind, ordered)
+		matched = err == nil && b.contains(kind, v)
+	case len(clause.Range) > 0:
+		for _, queryValue := range clause.Range {
+			matched = matched || equals(queryValue)
+		}
+	case len(clause.In) > 0:
+		for _, queryValue := range clause.In {
+			matched = matched || equals(queryValue)
+		}
+	default:
+		matched = equals(clause.Equals)
+	}
+	return matched
+}
+
 func (idx Index) add(model string, field string, value interface{}, id int) {
-	key := makeKey(model, field, value)
-	val := makeVal(model, field, id)
-	idx.KV[key] = append(idx.KV[key], id)
-	idx.VK[val] = append(idx.VK[val], key)
+	key := makeKey(model, field, indexValue(reflect.ValueOf(value)))
+	_ = idx.addDirectly(key, id)
 }
 
 func (idx Index) addDirectly(key string, id int) error {
@@ -78,8 +389,14 @@ func (idx Index) addDirectly(key string, id int) error {
 	if err != nil {
 		return err
 	}
+	for _, existingID := range idx.KV[key] {
+		if existingID == id {
+			return nil
+		}
+	}
 	idx.KV[key] = append(idx.KV[key], id)
 	idx.VK[val] = append(idx.VK[val], key)
+	idx.updateSorted(key, id, true)
 	return nil
 }
 
@@ -91,7 +408,8 @@ func (idx Index) remove(model string, field string, id int) {
 func (idx Index) removeDirectly(val string, id int) {
 	keys := idx.VK[val]
 	for _, key := range keys {
-		last := len(idx.KV[key])-1
+		idx.updateSorted(key, id, false)
+		last := len(idx.KV[key]) - 1
 		if last == 0 {
 			delete(idx.KV, key)
 		} else {
@@ -107,8 +425,9 @@ func (idx Index) removeDirectly(val string, id int) {
 	delete(idx.VK, val)
 }
 
-func makeKey(model string, field string, value interface{}) (key string) {
-	key = fmt.Sprintf("%s:%s:%v", model, field, value)
+// makeKey returns the index key of a field's value encoded by indexValue.
+func makeKey(model string, field string, value string) (key string) {
+	key = model + ":" + field + ":" + value
 	return
 }
 
@@ -0,0 +1,619 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The index log and its snapshot start with a generation header. CompactIndex
+// writes a snapshot of the next generation and then truncates the log, so a
+// log with a smaller generation than the snapshot is already contained in it.
+const indexLogGenHeader = "#gen "
+
+// indexLogFormat follows the generation in the header of index logs whose
+// values are typed and escaped. Logs without it are converted when replayed.
+const indexLogFormat = "v2"
+
+func indexLogHeader(gen int) string {
+	return fmt.Sprintf("%s%d %s\n", indexLogGenHeader, gen, indexLogFormat)
+}
+
+// sealedLogEntryPrefix starts the lines of encrypted directories' index logs
+// and snapshots. Each line holds one entry encrypted with the directory's key
+// and base64 encoded, so that lines stay free of newlines and an interrupted
+// append only affects the last line.
+const sealedLogEntryPrefix = "*"
+
+// formatLogEntries returns the index log lines of the given entries, sealed
+// if the directory is encrypted.
+func (dir Directory) formatLogEntries(logEntries []string) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, logEntry := range logEntries {
+		if dir.Encrypted {
+			sealed, err := dir.seal([]byte(logEntry))
+			if err != nil {
+				return nil, err
+			}
+			logEntry = sealedLogEntryPrefix + base64.RawStdEncoding.EncodeToString(sealed)
+		}
+		buf.WriteString(logEntry + "\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// parseLogLine returns the entry of an index log line, which is decrypted if
+// the line is sealed. Plaintext lines of encrypted directories are left
+// behind by versions which didn't encrypt the index log and are marked for
+// compaction. They are rejected once the directory's metadata is sealed.
+func (dir Directory) parseLogLine(line string) (string, error) {
+	if !strings.HasPrefix(line, sealedLogEntryPrefix) {
+		if dir.Encrypted && !dir.plaintextAllowed() {
+			return "", ErrDecrypt
+		}
+		if dir.Encrypted {
+			dir.indexLog.plaintext = true
+		}
+		return line, nil
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(line[len(sealedLogEntryPrefix):])
+	if err != nil {
+		return "", err
+	}
+	if !dir.Encrypted {
+		return "", errors.New("Index log is encrypted")
+	}
+	logEntry, err := dir.unseal(sealed)
+	return string(logEntry), err
+}
+
+// indexLogState tracks how much of the index log has been applied to the
+// in-memory index. It is shared by all copies of a Directory.
+type indexLogState struct {
+	gen               int
+	offset            int64
+	lines             int
+	stale             bool
+	plaintext         bool
+	compactAfterBytes int64
+	compactAfterLines int
+	// applied is the index log file as of the last refresh, see
+	// refreshIndex.
+	applied os.FileInfo
+}
+
+func (dir Directory) indexSnapshotPath() string {
+	return dir.IndexLogPath + ".snapshot"
+}
+
+// ReplayIndexLog rebuilds the in-memory index from the index snapshot and the
+// index log. It returns an *ErrCorruptIndexLog if a line can't be processed.
+func (dir Directory) ReplayIndexLog() error {
+	dir.Index.mutex.Lock()
+	defer dir.Index.mutex.Unlock()
+
+	if _, err := os.Stat(dir.Path); os.IsNotExist(err) {
+		dir.Index.clear()
+		return nil
+	}
+	l, err := lockFile(dir.IndexLogPath+".lock", true, true)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	return dir.replayIndexLog()
+}
+
+// replayIndexLog does the work of ReplayIndexLog. Legacy snapshots and logs
+// are converted and compacted into the current format. The caller must hold
+// the index mutex and the index log's file lock.
+func (dir Directory) replayIndexLog() error {
+	dir.Index.clear()
+	dir.indexLog.plaintext = false
+
+	snapshotGen, snapshotLegacy, err := readIndexLogGen(dir.indexSnapshotPath())
+	if err != nil {
+		return err
+	}
+	logGen, logLegacy, err := readIndexLogGen(dir.IndexLogPath)
+	if err != nil {
+		return err
+	}
+	var types map[string]reflect.Type
+	if snapshotLegacy || logLegacy {
+		types = dir.schemaTypes()
+	}
+	if snapshotGen > 0 {
+		_, _, err = dir.applyIndexLogFile(dir.indexSnapshotPath(), 0, snapshotLegacy, types)
+		if err != nil {
+			return err
+		}
+	}
+
+	state := dir.indexLog
+	if logGen < snapshotGen {
+		state.gen = snapshotGen
+		state.offset = 0
+		state.lines = 0
+		state.stale = true
+	} else {
+		state.gen = logGen
+		state.stale = false
+		state.offset, state.lines, err = dir.applyIndexLogFile(dir.IndexLogPath, 0, logLegacy, types)
+		if err != nil {
+			return err
+		}
+	}
+	if snapshotLegacy || logLegacy || state.plaintext {
+		return dir.compactIndex()
+	}
+	return nil
+}
+
+// schemaTypes returns the resource types recorded in the schemas of the model
+// directories by model name. Models without a readable schema are left out.
+func (dir Directory) schemaTypes() map[string]reflect.Type {
+	types := map[string]reflect.Type{}
+	files, err := ioutil.ReadDir(dir.Path)
+	if err != nil {
+		return types
+	}
+	for _, f := range files {
+		if !f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		model, resourceType, err := dir.readSchema(dir.Path + "/" + f.Name() + "/metadata")
+		if err != nil {
+			continue
+		}
+		if model == "" {
+			model = f.Name()
+		}
+		types[model] = resourceType
+	}
+	return types
+}
+
+// readIndexLogGen returns the generation of an index log or snapshot file and
+// whether it was written in a legacy format. Files without a generation header
+// and missing files are of generation 0.
+func readIndexLogGen(path string) (gen int, legacy bool, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, false, err
+	}
+	if !strings.HasPrefix(line, indexLogGenHeader) || !strings.HasSuffix(line, "\n") {
+		return 0, strings.HasSuffix(line, "\n"), nil
+	}
+	fields := strings.Fields(line[len(indexLogGenHeader):])
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, false, &ErrCorruptIndexLog{Path: path, Line: 1, Text: strings.TrimSpace(line)}
+	}
+	gen, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, false, &ErrCorruptIndexLog{Path: path, Line: 1, Text: strings.TrimSpace(line)}
+	}
+	return gen, len(fields) == 1 || fields[1] != indexLogFormat, nil
+}
+
+// applyIndexLogFile applies the entries of an index log or snapshot file to
+// the in-memory index, starting at the given byte offset. It returns the
+// offset after the last complete line and the number of applied entries.
+// An incomplete last line, left behind by an interrupted append, is ignored.
+// Entries of legacy files are converted with the resource types by model
+// before they are applied.
+func (dir Directory) applyIndexLogFile(path string, offset int64, legacy bool, types map[string]reflect.Type) (end int64, entries int, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end = offset
+	lineNumber := 0
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return end, entries, nil
+		}
+		if err != nil {
+			return end, entries, err
+		}
+		end += int64(len(line))
+		lineNumber++
+		line = line[:len(line)-1]
+		if offset == 0 && lineNumber == 1 && strings.HasPrefix(line, indexLogGenHeader) {
+			continue
+		}
+		logEntry, err := dir.parseLogLine(line)
+		if errors.Is(err, ErrDecrypt) {
+			return end, entries, fmt.Errorf("%s line %d: %w", path, lineNumber, err)
+		}
+		if err != nil {
+			return end, entries, &ErrCorruptIndexLog{Path: path, Line: lineNumber, Text: line}
+		}
+		if legacy {
+			logEntry = convertLegacyLogEntry(logEntry, types)
+		}
+		err = dir.Index.applyLogEntry(logEntry)
+		if err != nil {
+			return end, entries, &ErrCorruptIndexLog{Path: path, Line: lineNumber, Text: line}
+		}
+		entries++
+	}
+}
+
+// catchUpIndexLog applies entries appended to the index log by other processes
+// and removes an incomplete last line. The caller must hold the index mutex
+// and the index log's file lock.
+func (dir Directory) catchUpIndexLog() error {
+	state := dir.indexLog
+	logGen, _, err := readIndexLogGen(dir.IndexLogPath)
+	if err != nil {
+		return err
+	}
+	if logGen != state.gen || state.stale {
+		err = dir.replayIndexLog()
+		if err != nil {
+			return err
+		}
+		if state.stale {
+			header := []byte(indexLogHeader(state.gen))
+			err = writeToDisk(dir.IndexLogPath, header)
+			if err != nil {
+				return err
+			}
+			state.offset = int64(len(header))
+			state.stale = false
+		}
+	} else {
+		end, entries, err := dir.applyIndexLogFile(dir.IndexLogPath, state.offset, false, nil)
+		if err != nil {
+			return err
+		}
+		state.offset = end
+		state.lines += entries
+	}
+
+	info, err := os.Stat(dir.IndexLogPath)
+	switch {
+	case os.IsNotExist(err) || (err == nil && info.Size() == 0):
+		// A new log starts with a header so that it isn't taken for a legacy one.
+		header := []byte(indexLogHeader(state.gen))
+		err = writeToDisk(dir.IndexLogPath, header)
+		state.offset = int64(len(header))
+		state.lines = 0
+	case err == nil && info.Size() > state.offset:
+		err = os.Truncate(dir.IndexLogPath, state.offset)
+	}
+	return err
+}
+
+// RefreshIndex applies entries other processes appended to the index log
+// since the index was last read, so that queries evaluated on the index see
+// their writes.
+func (q *Query) RefreshIndex() {
+	if q.FatalError != nil {
+		return
+	}
+	q.FatalError = q.Dir.refreshIndex()
+}
+
+// RefreshIndexForOrder refreshes the index like RefreshIndex if the query is
+// ordered, which is the only use of the index by queries without where
+// clauses.
+func (q *Query) RefreshIndexForOrder() {
+	if q.FatalError != nil || q.Order == nil {
+		return
+	}
+	q.RefreshIndex()
+}
+
+// refreshIndex does the work of RefreshIndex. If the index log is still the
+// file last applied and hasn't been modified since, which is checked under
+// the index's read lock, nothing is done, so that readers don't wait for each
+// other. Otherwise new entries are read under a shared file lock. Only if the
+// index has been compacted meanwhile, the log is replayed under the exclusive
+// lock writers take.
+func (dir Directory) refreshIndex() error {
+	if dir.Path == "" || dir.indexLog == nil {
+		return nil
+	}
+	info, err := os.Stat(dir.IndexLogPath)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(dir.Path); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	state := dir.indexLog
+	if err == nil {
+		dir.Index.mutex.RLock()
+		current := !state.stale && state.applied != nil && os.SameFile(state.applied, info) &&
+			info.ModTime().Equal(state.applied.ModTime()) && info.Size() == state.offset
+		dir.Index.mutex.RUnlock()
+		if current {
+			return nil
+		}
+	}
+
+	dir.Index.mutex.Lock()
+	defer dir.Index.mutex.Unlock()
+
+	l, err := lockFile(dir.IndexLogPath+".lock", false, true)
+	if err != nil {
+		return err
+	}
+	logGen, _, err := readIndexLogGen(dir.IndexLogPath)
+	if err == nil && logGen == state.gen && !state.stale {
+		var end int64
+		var entries int
+		end, entries, err = dir.applyIndexLogFile(dir.IndexLogPath, state.offset, false, nil)
+		state.offset = end
+		state.lines += entries
+	}
+	if err == nil && logGen == state.gen && !state.stale {
+		state.applied, err = os.Stat(dir.IndexLogPath)
+	}
+	if unlockErr := l.unlock(); err == nil {
+		err = unlockErr
+	}
+	if err != nil || (logGen == state.gen && !state.stale) {
+		return err
+	}
+
+	l, err = lockFile(dir.IndexLogPath+".lock", true, true)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+	err = dir.catchUpIndexLog()
+	if err == nil {
+		state.applied, err = os.Stat(dir.IndexLogPath)
+	}
+	return err
+}
+
+// updateIndex appends the given entries to the index log and applies them to
+// the in-memory index.
+func (dir Directory) updateIndex(logEntries []string) error {
+	if len(logEntries) == 0 {
+		return nil
+	}
+
+	dir.Index.mutex.Lock()
+	defer dir.Index.mutex.Unlock()
+
+	l, err := lockFile(dir.IndexLogPath+".lock", true, true)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	err = dir.catchUpIndexLog()
+	if err != nil {
+		return err
+	}
+	b, err := dir.formatLogEntries(logEntries)
+	if err != nil {
+		return err
+	}
+	err = appendToDisk(dir.IndexLogPath, b)
+	if err != nil {
+		return err
+	}
+	return dir.indexLogAppended(int64(len(b)), logEntries)
+}
+
+// indexLogAppended applies entries which have just been appended to the index
+// log and compacts the index if a threshold has been reached. The caller must
+// hold the index mutex and the index log's file lock.
+func (dir Directory) indexLogAppended(size int64, logEntries []string) error {
+	state := dir.indexLog
+	state.offset += size
+	state.lines += len(logEntries)
+	for _, logEntry := range logEntries {
+		err := dir.Index.applyLogEntry(logEntry)
+		if err != nil {
+			return err
+		}
+	}
+
+	if (state.compactAfterBytes > 0 && state.offset >= state.compactAfterBytes) ||
+		(state.compactAfterLines > 0 && state.lines >= state.compactAfterLines) {
+		return dir.compactIndex()
+	}
+	return nil
+}
+
+// CompactIndex writes a snapshot of the current index and truncates the index
+// log, so that opening the directory only replays the snapshot and the log's tail.
+func (dir Directory) CompactIndex() error {
+	if dir.Path == "" {
+		return errors.New("Directory path missing")
+	}
+
+	dir.Index.mutex.Lock()
+	defer dir.Index.mutex.Unlock()
+
+	l, err := lockFile(dir.IndexLogPath+".lock", true, true)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	err = dir.catchUpIndexLog()
+	if err != nil {
+		return err
+	}
+	return dir.compactIndex()
+}
+
+// compactIndex does the work of CompactIndex. The caller must hold the index
+// mutex and the index log's file lock.
+func (dir Directory) compactIndex() error {
+	state := dir.indexLog
+	gen := state.gen + 1
+	header := indexLogHeader(gen)
+
+	keys := make([]string, 0, len(dir.Index.KV))
+	for key := range dir.Index.KV {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	logEntries := []string{}
+	for _, key := range keys {
+		for _, id := range dir.Index.KV[key] {
+			logEntries = append(logEntries, fmt.Sprintf("+%s=%d", key, id))
+		}
+	}
+	b, err := dir.formatLogEntries(logEntries)
+	if err != nil {
+		return err
+	}
+	err = writeToDisk(dir.indexSnapshotPath(), append([]byte(header), b...))
+	if err != nil {
+		return err
+	}
+	err = writeToDisk(dir.IndexLogPath, []byte(header))
+	if err != nil {
+		return err
+	}
+
+	state.gen = gen
+	state.offset = int64(len(header))
+	state.lines = 0
+	state.stale = false
+	state.plaintext = false
+	return nil
+}
+
+// RebuildIndex regenerates the index entries of the given resource types by
+// decoding every serialized resource and writes a fresh index log. Use it
+// after the index log has been lost or a field has been tagged as indexed.
+func (dir Directory) RebuildIndex(resourceTypes ...interface{}) error {
+	models := map[string]reflect.Type{}
+	for _, resource := range resourceTypes {
+		if resource == nil {
+			return &QueryError{Op: "rebuild index", Err: errors.New("Resource missing")}
+		}
+		models[modelOf(resource)] = reflect.TypeOf(resource)
+	}
+	_, err := dir.rebuildIndex(models)
+	return err
+}
+
+// rebuildIndex does the work of RebuildIndex for the given model names and
+// resource pointer types. It returns the number of resources per model.
+func (dir Directory) rebuildIndex(models map[string]reflect.Type) (map[string]int, error) {
+	if dir.Path == "" {
+		return nil, &QueryError{Op: "rebuild index", Err: errors.New("Directory path missing")}
+	}
+	names := []string{}
+	for model := range models {
+		names = append(names, model)
+	}
+	sort.Strings(names)
+	for _, model := range names {
+		defer dir.lockModel(model, true)()
+	}
+
+	counts := map[string]int{}
+	logEntries := []string{}
+	for _, model := range names {
+		q := dir.newQueryWithoutID("rebuild index", nil)
+		q.Model = model
+		q.ResourceType = models[model]
+		q.BuildDirPath()
+		q.ThwartIOBasePathEscape()
+		q.ExitIfDirNotExist()
+		if q.FatalError == ErrModelDirMissing {
+			continue
+		}
+		q.BuildMetadataPath()
+		q.CreateMetadataDirectoryIfNotExist()
+		// The file locks are held until the index log has been rewritten, so
+		// that writes of other processes meanwhile aren't lost.
+		q.LockFile()
+		defer q.UnlockFile()
+		q.WriteSchema()
+		q.ReadDirFileinfo()
+		for _, f := range q.DirFileInfo {
+			if f.IsDir() {
+				continue
+			}
+			id, err := strconv.Atoi(f.Name())
+			if err != nil {
+				continue
+			}
+			q.ID = id
+			q.Resource = reflect.New(q.ResourceType.Elem()).Interface()
+			q.BuildResourcePath()
+			q.ReadGobFromDisk()
+			q.DecryptGobBuffer()
+			q.DecodeGobToResource()
+			if q.FatalError != nil {
+				break
+			}
+			logEntries = append(logEntries, indexLogEntries(model, q.ResourceType, q.Resource, q.ID, '+')...)
+			counts[model]++
+		}
+		q.Log()
+		if q.FatalError != nil {
+			return nil, q.Err()
+		}
+	}
+
+	dir.Index.mutex.Lock()
+	defer dir.Index.mutex.Unlock()
+
+	l, err := lockFile(dir.IndexLogPath+".lock", true, true)
+	if err != nil {
+		return nil, err
+	}
+	defer l.unlock()
+
+	err = dir.catchUpIndexLog()
+	if err != nil {
+		return nil, err
+	}
+	for _, model := range names {
+		dir.Index.removeModel(model)
+	}
+	for _, logEntry := range logEntries {
+		err = dir.Index.applyLogEntry(logEntry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return counts, dir.compactIndex()
+}
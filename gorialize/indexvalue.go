@@ -0,0 +1,300 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// indexValueEscaper escapes the characters separating the parts of index keys,
+// composite index values and index log entries, so that any string
+// round-trips through the index log.
+var indexValueEscaper = strings.NewReplacer(
+	"%", "%25",
+	":", "%3A",
+	"=", "%3D",
+	",", "%2C",
+	"\n", "%0A",
+	"\r", "%0D",
+)
+
+var indexValueUnescaper = strings.NewReplacer(
+	"%25", "%",
+	"%3A", ":",
+	"%3D", "=",
+	"%2C", ",",
+	"%0A", "\n",
+	"%0D", "\r",
+)
+
+func escapeIndexValue(s string) string {
+	return indexValueEscaper.Replace(s)
+}
+
+func unescapeIndexValue(s string) string {
+	return indexValueUnescaper.Replace(s)
+}
+
+// indexValue returns the index key representation of a field's value.
+func indexValue(v reflect.Value) string {
+	return escapeIndexValue(formatIndexValue(v))
+}
+
+// formatIndexValue formats a value depending on its kind. Values of the same
+// type are formatted the same way no matter how they print with %v.
+func formatIndexValue(v reflect.Value) string {
+	if v.Type() == timeType {
+		return v.Interface().(time.Time).UTC().Format(timeLayout)
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 32)
+	case reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.String:
+		return v.String()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// convertIndexValue converts a query value to the given field type. Numbers
+// are converted between kinds as long as they fit, strings are parsed for
+// number, bool and time.Time fields, which also accept RFC 3339 strings.
+func convertIndexValue(t reflect.Type, value interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(value)
+	fail := func() (reflect.Value, error) {
+		return reflect.Value{}, fmt.Errorf("Can't convert %v (%T) to %s", value, value, t)
+	}
+	if !v.IsValid() {
+		return fail()
+	}
+	if v.Type() == t {
+		return v, nil
+	}
+	if t == timeType {
+		s, ok := value.(string)
+		if !ok {
+			return fail()
+		}
+		tm, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return fail()
+		}
+		return reflect.ValueOf(tm), nil
+	}
+
+	out := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			i = v.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if v.Uint() > math.MaxInt64 {
+				return fail()
+			}
+			i = int64(v.Uint())
+		case reflect.Float32, reflect.Float64:
+			f := v.Float()
+			if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+				return fail()
+			}
+			i = int64(f)
+		case reflect.String:
+			var err error
+			i, err = strconv.ParseInt(v.String(), 10, 64)
+			if err != nil {
+				return fail()
+			}
+		default:
+			return fail()
+		}
+		if out.OverflowInt(i) {
+			return fail()
+		}
+		out.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if v.Int() < 0 {
+				return fail()
+			}
+			u = uint64(v.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			u = v.Uint()
+		case reflect.Float32, reflect.Float64:
+			f := v.Float()
+			if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 {
+				return fail()
+			}
+			u = uint64(f)
+		case reflect.String:
+			var err error
+			u, err = strconv.ParseUint(v.String(), 10, 64)
+			if err != nil {
+				return fail()
+			}
+		default:
+			return fail()
+		}
+		if out.OverflowUint(u) {
+			return fail()
+		}
+		out.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			f = float64(v.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			f = float64(v.Uint())
+		case reflect.Float32, reflect.Float64:
+			f = v.Float()
+		case reflect.String:
+			var err error
+			f, err = strconv.ParseFloat(v.String(), 64)
+			if err != nil {
+				return fail()
+			}
+		default:
+			return fail()
+		}
+		if out.OverflowFloat(f) {
+			return fail()
+		}
+		out.SetFloat(f)
+	case reflect.Bool:
+		switch v.Kind() {
+		case reflect.Bool:
+			out.SetBool(v.Bool())
+		case reflect.String:
+			b, err := strconv.ParseBool(v.String())
+			if err != nil {
+				return fail()
+			}
+			out.SetBool(b)
+		default:
+			return fail()
+		}
+	case reflect.String:
+		if v.Kind() != reflect.String {
+			return fail()
+		}
+		out.SetString(v.String())
+	default:
+		if v.Kind() != t.Kind() || !v.Type().ConvertibleTo(t) {
+			return fail()
+		}
+		out = v.Convert(t)
+	}
+	return out, nil
+}
+
+// fieldIndexKey returns the index key of a query value compared with a field
+// of the resource type. Values of composite index fields are already encoded
+// by the query planner.
+func fieldIndexKey(model string, resourceType reflect.Type, field string, value interface{}) (string, error) {
+	if isCompositeField(field) {
+		encoded, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("Invalid composite index value %v", value)
+		}
+		return makeKey(model, field, encoded), nil
+	}
+	fp, err := lookupField(resourceType, field)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := fp.encodeValue(value)
+	if err != nil {
+		return "", fmt.Errorf("Field %s: %v", field, err)
+	}
+	return makeKey(model, fp.name, encoded), nil
+}
+
+// legacyTimeLayout is the layout time.Time values were formatted with by %v in
+// index logs written before index values were typed.
+const legacyTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// convertLegacyLogEntry converts an index log entry written before index
+// values were typed and escaped. Such values were formatted with %v, which
+// formats numbers, bools and strings the same way formatIndexValue does, so
+// apart from time.Time values they only need to be escaped. Values are only
+// converted to times if the model's resource type, looked up in types, has
+// a time.Time field of that name.
+func convertLegacyLogEntry(logEntry string, types map[string]reflect.Type) string {
+	eq := strings.LastIndex(logEntry, "=")
+	if !strings.HasPrefix(logEntry, "+") || eq < 0 {
+		return logEntry
+	}
+	parts := strings.SplitN(logEntry[1:eq], ":", 3)
+	if len(parts) != 3 {
+		return logEntry
+	}
+	resourceType := types[parts[0]]
+	isTime := func(field string) bool {
+		if resourceType == nil {
+			return false
+		}
+		fp, err := lookupField(resourceType, field)
+		return err == nil && fp.typ == timeType
+	}
+
+	var encoded string
+	if isCompositeField(parts[1]) {
+		fields := []string{}
+		if resourceType != nil {
+			for _, c := range compositeIndexes(resourceType) {
+				if c.field() == parts[1] {
+					fields = c.fields
+				}
+			}
+		}
+		values := []string{}
+		rest := parts[2]
+		for rest != "" {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return logEntry
+			}
+			value, _ := strconv.Unquote(quoted)
+			if len(values) < len(fields) && isTime(fields[len(values)]) {
+				value = convertLegacyTime(value)
+			}
+			values = append(values, escapeIndexValue(value))
+			rest = strings.TrimPrefix(rest[len(quoted):], ",")
+		}
+		encoded = strings.Join(values, ",")
+	} else {
+		value := parts[2]
+		if isTime(parts[1]) {
+			value = convertLegacyTime(value)
+		}
+		encoded = escapeIndexValue(value)
+	}
+	return "+" + makeKey(parts[0], parts[1], encoded) + logEntry[eq:]
+}
+
+func convertLegacyTime(s string) string {
+	layout := s
+	if i := strings.Index(layout, " m="); i >= 0 {
+		layout = layout[:i]
+	}
+	t, err := time.Parse(legacyTimeLayout, layout)
+	if err != nil {
+		return s
+	}
+	return t.UTC().Format(timeLayout)
+}
@@ -4,11 +4,46 @@ package gorialize
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
+// tmpFileSuffix marks files that are being written and have not yet been
+// renamed into place. Leftovers are removed by removeTempFiles.
+const tmpFileSuffix = ".tmp"
+
+// writeToDisk atomically replaces the file at path with b. The data is written
+// to a temporary file in the same directory, fsynced, renamed into place and
+// finally the parent directory is fsynced so that the rename itself is durable.
 func writeToDisk(path string, b []byte) error {
-	err := ioutil.WriteFile(path, b, 0644)
-	return err
+	dirPath, filename := filepath.Split(path)
+	if dirPath == "" {
+		dirPath = "."
+	}
+	f, err := ioutil.TempFile(dirPath, "."+filename+".*"+tmpFileSuffix)
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(dirPath)
 }
 
 func readFromDisk(path string) ([]byte, error) {
@@ -16,7 +51,66 @@ func readFromDisk(path string) ([]byte, error) {
 	return b, err
 }
 
+// appendToDisk appends b to the file at path, creating it if necessary, and
+// fsyncs the file before returning.
+func appendToDisk(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 func deleteFromDisk(path string) error {
 	err := os.Remove(path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir fsyncs a directory so that renames and removals inside it are durable.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
 	return err
 }
+
+// isTempFile reports whether filename was created by writeToDisk.
+func isTempFile(filename string) bool {
+	return strings.HasPrefix(filename, ".") && strings.HasSuffix(filename, tmpFileSuffix)
+}
+
+// findTempFiles returns the temporary files left behind by interrupted writes
+// anywhere below basePath, grouped by their directory.
+func findTempFiles(basePath string) (map[string][]string, error) {
+	tmpFiles := map[string][]string{}
+	err := filepath.Walk(basePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || !isTempFile(info.Name()) {
+			return nil
+		}
+		dirPath := filepath.Dir(path)
+		tmpFiles[dirPath] = append(tmpFiles[dirPath], path)
+		return nil
+	})
+	return tmpFiles, err
+}
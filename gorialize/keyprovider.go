@@ -0,0 +1,123 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// kdfRaw is recorded in the key parameters of directories whose key is
+// supplied as is by a KeyProvider instead of being derived from a passphrase.
+const kdfRaw = "raw"
+
+// KeyMaterial is what a KeyProvider supplies: either a passphrase the
+// directory's key is derived from or, if Key is set, the key itself.
+type KeyMaterial struct {
+	Passphrase string
+	Key        *[32]byte
+}
+
+// KeyProvider supplies the key of an encrypted directory when it is opened,
+// see DirectoryConfig.KeyProvider.
+type KeyProvider interface {
+	ProvideKey() (KeyMaterial, error)
+}
+
+// deriveKey returns the raw key or derives the key from the passphrase.
+func (m KeyMaterial) deriveKey(params keyParams) (*[32]byte, error) {
+	if m.Key != nil {
+		return m.Key, nil
+	}
+	return params.deriveKey(m.Passphrase)
+}
+
+// legacyKey returns the key resources were encrypted with before keys were
+// derived with a salt. Raw keys were always used as is.
+func (m KeyMaterial) legacyKey() *[32]byte {
+	if m.Key != nil {
+		return m.Key
+	}
+	return legacyKey(m.Passphrase)
+}
+
+type keyFile string
+
+// KeyFile reads a raw 32 byte key from the file at path.
+func KeyFile(path string) KeyProvider {
+	return keyFile(path)
+}
+
+func (path keyFile) ProvideKey() (KeyMaterial, error) {
+	b, err := ioutil.ReadFile(string(path))
+	if err != nil {
+		return KeyMaterial{}, err
+	}
+	if len(b) != 32 {
+		return KeyMaterial{}, fmt.Errorf("Key file %s holds %d bytes instead of 32", path, len(b))
+	}
+	var key [32]byte
+	copy(key[:], b)
+	return KeyMaterial{Key: &key}, nil
+}
+
+type envPassphrase string
+
+// EnvPassphrase reads the passphrase from the environment variable name.
+func EnvPassphrase(name string) KeyProvider {
+	return envPassphrase(name)
+}
+
+func (name envPassphrase) ProvideKey() (KeyMaterial, error) {
+	passphrase := os.Getenv(string(name))
+	if passphrase == "" {
+		return KeyMaterial{}, fmt.Errorf("Environment variable %s not set", name)
+	}
+	return KeyMaterial{Passphrase: passphrase}, nil
+}
+
+type commandPassphrase []string
+
+// CommandPassphrase runs a command, e.g. a password manager, and reads the
+// passphrase from its output without the trailing newline.
+func CommandPassphrase(name string, args ...string) KeyProvider {
+	return commandPassphrase(append([]string{name}, args...))
+}
+
+func (command commandPassphrase) ProvideKey() (KeyMaterial, error) {
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if msg := strings.TrimSpace(stderr.String()); err != nil && msg != "" {
+		return KeyMaterial{}, fmt.Errorf("Key command %s failed: %v: %s", command[0], err, msg)
+	}
+	if err != nil {
+		return KeyMaterial{}, fmt.Errorf("Key command %s failed: %v", command[0], err)
+	}
+	passphrase := strings.TrimRight(string(out), "\r\n")
+	if passphrase == "" {
+		return KeyMaterial{}, errors.New("Key command " + command[0] + " printed no passphrase")
+	}
+	return KeyMaterial{Passphrase: passphrase}, nil
+}
+
+type staticKey KeyMaterial
+
+// StaticKey supplies the given key, e.g. in tests.
+func StaticKey(key [32]byte) KeyProvider {
+	return staticKey{Key: &key}
+}
+
+// StaticPassphrase supplies the given passphrase.
+func StaticPassphrase(passphrase string) KeyProvider {
+	return staticKey{Passphrase: passphrase}
+}
+
+func (m staticKey) ProvideKey() (KeyMaterial, error) {
+	return KeyMaterial(m), nil
+}
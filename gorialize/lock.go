@@ -0,0 +1,99 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// errWouldBlock is returned by lockFile if the lock is held and wait is false.
+var errWouldBlock = errors.New("file lock is held by another process")
+
+// lockManager hands out one RWMutex per directory path and model so that
+// queries on unrelated models or directories never contend.
+type lockManager struct {
+	mutex sync.Mutex
+	locks map[string]*sync.RWMutex
+}
+
+var locks = &lockManager{
+	locks: map[string]*sync.RWMutex{},
+}
+
+func (lm *lockManager) get(path string, model string) *sync.RWMutex {
+	key := filepath.Clean(path) + "\x00" + model
+
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+
+	l, ok := lm.locks[key]
+	if !ok {
+		l = &sync.RWMutex{}
+		lm.locks[key] = l
+	}
+	return l
+}
+
+// lockModel locks the given model inside the directory for
+// reading or writing and returns the matching unlock function.
+func (dir Directory) lockModel(model string, write bool) (unlock func()) {
+	l := locks.get(dir.Path, model)
+	if write {
+		l.Lock()
+		return l.Unlock
+	}
+	l.RLock()
+	return l.RUnlock
+}
+
+// modelOf returns the model name of a resource pointer the same way
+// Query.ReflectModelNameFromType does.
+func modelOf(resource interface{}) string {
+	if resource == nil {
+		return ""
+	}
+	name := reflect.TypeOf(resource).String()
+	if len(name) == 0 || name[0] != '*' {
+		return name
+	}
+	return name[1:]
+}
+
+// lockFiles takes exclusive file locks on the given paths in the given order
+// and returns a function which releases them in reverse order. Callers must
+// always lock model files before the index log file to avoid deadlocks.
+func lockFiles(paths []string) (unlock func() error, err error) {
+	held := []*fileLock{}
+	unlock = func() error {
+		var err error
+		for i := len(held) - 1; i >= 0; i-- {
+			if unlockErr := held[i].unlock(); err == nil {
+				err = unlockErr
+			}
+		}
+		return err
+	}
+	for _, path := range paths {
+		l, err := lockFile(path, true, true)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		held = append(held, l)
+	}
+	return unlock, nil
+}
+
+func uniqueSorted(s []string) []string {
+	sort.Strings(s)
+	unique := s[:0]
+	for i, e := range s {
+		if i == 0 || e != s[i-1] {
+			unique = append(unique, e)
+		}
+	}
+	return unique
+}
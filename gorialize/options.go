@@ -0,0 +1,418 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// QueryOption is accepted by Find, FindCB, ReadAll and ReadAllCB. Where
+// clauses are query options as well as OrderBy, Limit, Offset, After and
+// NextCursor.
+type QueryOption interface {
+	applyTo(q *Query)
+}
+
+func (clause Where) applyTo(q *Query) {
+	q.WhereClauses = append(q.WhereClauses, clause)
+}
+
+// Wheres passes a slice of where clauses as a single query option. Slices
+// which were spread as in Find(&s, clauses...) before Find took query options
+// are passed as Find(&s, Wheres(clauses)).
+type Wheres []Where
+
+func (clauses Wheres) applyTo(q *Query) {
+	q.WhereClauses = append(q.WhereClauses, clauses...)
+}
+
+// Direction is the sort direction of OrderBy.
+type Direction int
+
+const (
+	Asc Direction = iota
+	Desc
+)
+
+// Order sorts the results of a query by a field. Ties are broken by ID.
+type Order struct {
+	Field     string
+	Direction Direction
+}
+
+func (o Order) applyTo(q *Query) {
+	q.Order = &o
+}
+
+// OrderBy sorts the results by field. Fields tagged `gorialize:"indexed"` are
+// sorted by their sorted index, other fields are sorted after decoding every
+// matching resource. Without OrderBy results are sorted by ascending ID.
+func OrderBy(field string, direction Direction) QueryOption {
+	return Order{Field: field, Direction: direction}
+}
+
+type limitOption int
+
+func (n limitOption) applyTo(q *Query) {
+	q.Limit = int(n)
+}
+
+// Limit returns at most n results. A limit of 0 means no limit.
+func Limit(n int) QueryOption {
+	return limitOption(n)
+}
+
+type offsetOption int
+
+func (n offsetOption) applyTo(q *Query) {
+	q.Offset = int(n)
+}
+
+// Offset skips the first n results.
+func Offset(n int) QueryOption {
+	return offsetOption(n)
+}
+
+type afterOption string
+
+func (cursor afterOption) applyTo(q *Query) {
+	q.Cursor = string(cursor)
+}
+
+// After returns the results following the one the cursor was created for.
+// Unlike Offset, a cursor keeps its position when resources are created or
+// deleted between two pages. The query must use the same order as the one
+// that produced the cursor.
+func After(cursor string) QueryOption {
+	return afterOption(cursor)
+}
+
+type nextCursorOption struct {
+	cursor *string
+}
+
+func (o nextCursorOption) applyTo(q *Query) {
+	q.NextCursor = o.cursor
+}
+
+// NextCursor sets *cursor to the cursor of the last returned result if there
+// are more results to page through and to "" otherwise.
+func NextCursor(cursor *string) QueryOption {
+	return nextCursorOption{cursor: cursor}
+}
+
+// cursor is the decoded form of the opaque cursors passed to After.
+type cursor struct {
+	Field string `json:"f,omitempty"`
+	Desc  bool   `json:"d,omitempty"`
+	Value string `json:"v,omitempty"`
+	ID    int    `json:"i"`
+}
+
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (c cursor, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil {
+		err = errors.New("Invalid cursor")
+	}
+	return
+}
+
+// formatOrdered formats a value so that parseOrdered returns it unchanged.
+func formatOrdered(kind orderKind, v orderedValue) string {
+	switch kind {
+	case orderInt:
+		return strconv.FormatInt(v.i, 10)
+	case orderUint:
+		return strconv.FormatUint(v.u, 10)
+	case orderFloat:
+		return strconv.FormatFloat(v.f, 'g', -1, 64)
+	case orderString:
+		return v.s
+	case orderTime:
+		return v.t.UTC().Format(timeLayout)
+	}
+	return ""
+}
+
+// ApplyOptions applies query options to the query.
+func (q *Query) ApplyOptions(options []QueryOption) {
+	if q.FatalError != nil {
+		return
+	}
+	for _, option := range options {
+		option.applyTo(q)
+	}
+	if q.Limit < 0 {
+		q.FatalError = errors.New("Limit smaller than 0")
+		return
+	}
+	if q.Offset < 0 {
+		q.FatalError = errors.New("Offset smaller than 0")
+	}
+}
+
+func (q *Query) ExitIfWhereClauses() {
+	if q.FatalError != nil {
+		return
+	}
+	if len(q.WhereClauses) > 0 || len(q.Exprs) > 0 {
+		q.FatalError = errors.New("Where clauses not supported, use Find")
+	}
+}
+
+// ExitIfPagination fails if the query is sorted or paginated, which queries
+// counting or aggregating all matches don't support.
+func (q *Query) ExitIfPagination() {
+	if q.FatalError != nil {
+		return
+	}
+	if q.Order != nil || q.Limit != 0 || q.Offset != 0 || q.Cursor != "" || q.NextCursor != nil {
+		q.FatalError = fmt.Errorf("OrderBy, Limit, Offset, After and NextCursor not supported by %s", q.Operation)
+	}
+}
+
+// MatchIDsFromDirFileinfo matches the IDs of all resources in the directory.
+func (q *Query) MatchIDsFromDirFileinfo() {
+	if q.FatalError != nil {
+		return
+	}
+	q.MatchedIDs = q.MatchedIDs[:0]
+	for _, f := range q.DirFileInfo {
+		if f.IsDir() {
+			continue
+		}
+		id, err := strconv.Atoi(f.Name())
+		if err != nil {
+			continue
+		}
+		q.MatchedIDs = append(q.MatchedIDs, id)
+	}
+}
+
+// SortMatchedIDs sorts the matched IDs by the query's order. Without one,
+// queries with Match clauses are sorted by relevance and others by ID.
+func (q *Query) SortMatchedIDs() {
+	if q.FatalError != nil {
+		return
+	}
+	if q.Order == nil && hasMatch(q.rankedClauses()) {
+		q.Order = &Order{Field: relevanceField}
+	}
+	if q.plan != nil {
+		q.plan.Matched = len(q.MatchedIDs)
+		q.plan.Order = "id"
+	}
+	if q.Order == nil {
+		sort.Ints(q.MatchedIDs)
+		q.sorted = make([]sortedEntry, len(q.MatchedIDs))
+		for i, id := range q.MatchedIDs {
+			q.sorted[i] = sortedEntry{id: id}
+		}
+		return
+	}
+	if q.Order.Field == relevanceField {
+		q.orderKind = orderFloat
+		q.sortByRelevance()
+		if q.plan != nil {
+			q.plan.Order = "relevance"
+		}
+	} else {
+		q.sortByField()
+	}
+	if q.FatalError != nil {
+		return
+	}
+	if q.Order.Direction == Desc {
+		for i, j := 0, len(q.sorted)-1; i < j; i, j = i+1, j-1 {
+			q.sorted[i], q.sorted[j] = q.sorted[j], q.sorted[i]
+		}
+	}
+	for i, e := range q.sorted {
+		q.MatchedIDs[i] = e.id
+	}
+}
+
+// sortByField sorts the matched IDs by the order field, using its sorted
+// index if it is indexed.
+func (q *Query) sortByField() {
+	q.orderKind, q.FatalError = fieldOrderKind(q.ResourceType, q.Order.Field)
+	if q.FatalError != nil {
+		return
+	}
+	fp, _ := lookupField(q.ResourceType, q.Order.Field)
+	if fp.multi {
+		q.FatalError = fmt.Errorf("Field %s has multiple values and can't be ordered", q.Order.Field)
+		return
+	}
+	if q.Reader == nil && fp.tag.indexed {
+		q.sorted, q.FatalError = q.Dir.Index.sortedEntries(q.Model, fp.name, q.orderKind, q.MatchedIDs)
+	}
+	order := "index:" + fp.name
+	if q.FatalError == nil && len(q.sorted) != len(q.MatchedIDs) {
+		order = "decoded:" + fp.name
+		q.sortByDecodedValues(fp)
+	}
+	if q.plan != nil {
+		q.plan.Order = order
+	}
+}
+
+// sortByDecodedValues sorts the matched IDs by the order field's value in
+// each decoded resource. Resources without a value, e.g. because of a nil
+// pointer along the field's path, sort first.
+func (q *Query) sortByDecodedValues(fp fieldPath) {
+	si := &sortedIndex{kind: q.orderKind}
+	for _, id := range q.MatchedIDs {
+		candidate := reflect.New(q.ResourceType.Elem()).Interface()
+		q.FatalError = q.read(candidate, id)
+		if q.FatalError != nil {
+			return
+		}
+		var v orderedValue
+		if values := fp.values(reflect.ValueOf(candidate).Elem()); len(values) > 0 {
+			var err error
+			v, err = toOrdered(q.orderKind, values[0].Interface())
+			if err != nil {
+				q.FatalError = err
+				return
+			}
+		}
+		si.entries = append(si.entries, sortedEntry{value: v, id: id})
+	}
+	sort.Slice(si.entries, func(i, j int) bool {
+		return si.less(si.entries[i], si.entries[j])
+	})
+	q.sorted = si.entries
+}
+
+// read reads a matched resource without taking the model's lock, which the
+// calling query already holds, or with the query's Reader if it has one.
+func (q *Query) read(resource interface{}, id int) error {
+	if q.Reader != nil {
+		return q.Reader(resource, id)
+	}
+	r := q.Dir.newQueryWithID("read", resource, id)
+	r.plan = q.plan
+	r.ReflectTypeOfResource()
+	r.ReflectModelNameFromType()
+	r.BuildDirPath()
+	r.ThwartIOBasePathEscape()
+	r.BuildResourcePath()
+	r.ReadGobFromDisk()
+	r.DecryptGobBuffer()
+	r.DecodeGobToResource()
+	return r.FatalError
+}
+
+// ApplyCursor drops the sorted matched IDs up to and including the position
+// of the query's cursor.
+func (q *Query) ApplyCursor() {
+	if q.FatalError != nil {
+		return
+	}
+	if q.Cursor == "" {
+		return
+	}
+	c, err := decodeCursor(q.Cursor)
+	if err != nil {
+		q.FatalError = err
+		return
+	}
+	order := Order{}
+	if q.Order != nil {
+		order = *q.Order
+	}
+	if c.Field != order.Field || c.Desc != (order.Direction == Desc) {
+		q.FatalError = errors.New("Cursor does not match the query's order")
+		return
+	}
+	position := sortedEntry{id: c.ID}
+	if c.Field != "" {
+		position.value, err = parseOrdered(q.orderKind, c.Value)
+		if err != nil {
+			q.FatalError = errors.New("Invalid cursor")
+			return
+		}
+	}
+	si := &sortedIndex{kind: q.orderKind}
+	i := sort.Search(len(q.sorted), func(i int) bool {
+		if c.Desc {
+			return si.less(q.sorted[i], position)
+		}
+		return si.less(position, q.sorted[i])
+	})
+	q.sorted = q.sorted[i:]
+	q.MatchedIDs = q.MatchedIDs[len(q.MatchedIDs)-len(q.sorted):]
+}
+
+// PaginateMatchedIDs applies the query's offset and limit to the sorted
+// matched IDs and sets the next cursor.
+func (q *Query) PaginateMatchedIDs() {
+	if q.FatalError != nil {
+		return
+	}
+	offset := q.Offset
+	if offset > len(q.sorted) {
+		offset = len(q.sorted)
+	}
+	end := len(q.sorted)
+	if q.Limit > 0 && offset+q.Limit < end {
+		end = offset + q.Limit
+	}
+	more := end < len(q.sorted)
+	q.sorted = q.sorted[offset:end]
+	q.MatchedIDs = q.MatchedIDs[offset:end]
+
+	if q.NextCursor == nil {
+		return
+	}
+	*q.NextCursor = ""
+	if !more || len(q.sorted) == 0 {
+		return
+	}
+	last := q.sorted[len(q.sorted)-1]
+	c := cursor{ID: last.id}
+	if q.Order != nil {
+		c.Field = q.Order.Field
+		c.Desc = q.Order.Direction == Desc
+		c.Value = formatOrdered(q.orderKind, last.value)
+	}
+	*q.NextCursor = encodeCursor(c)
+}
+
+// sortedEntries returns the entries of the sorted index of a model's field
+// that belong to the given IDs, in order.
+func (idx Index) sortedEntries(model string, field string, kind orderKind, ids []int) ([]sortedEntry, error) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	si, err := idx.sortedIndexFor(model, field, kind)
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	entries := make([]sortedEntry, 0, len(ids))
+	for _, e := range si.entries {
+		if wanted[e.id] {
+			entries = append(entries, e)
+			delete(wanted, e.id)
+		}
+	}
+	return entries, nil
+}
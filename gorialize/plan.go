@@ -0,0 +1,243 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Plan describes how a query found its matches and how long it took.
+type Plan struct {
+	Operation string
+	Model     string
+	// Clauses describes how each where clause, expression or filter was
+	// evaluated.
+	Clauses []ClausePlan
+	// FullScan reports whether any clause decoded all resources of the model.
+	FullScan bool
+	// Order is how the matches were sorted: "id", "relevance", "index:Field"
+	// or "decoded:Field".
+	Order string
+	// Matched is the number of matches before pagination, Returned after.
+	Matched  int
+	Returned int
+	// Decoded is the number of resources read and decoded, including those
+	// scanned for clauses which aren't indexed.
+	Decoded     int
+	ReadTime    time.Duration
+	DecryptTime time.Duration
+	DecodeTime  time.Duration
+	Duration    time.Duration
+	start       time.Time
+}
+
+// ClausePlan describes how a where clause, expression or filter was evaluated.
+type ClausePlan struct {
+	// Clause is the evaluated clause, e.g. `Status = active AND Age >= 18`.
+	Clause string
+	// Indexes are the indexes the candidates were looked up in, e.g.
+	// "hash:Status", "sorted:Age", "composite:tenant_status", "fulltext:Body"
+	// or "listing" for the directory listing.
+	Indexes []string
+	// Scan is the part of the clause evaluated on the decoded candidates.
+	Scan string
+	// FullScan reports whether the candidates were all resources of the model.
+	FullScan bool
+	// Estimated is the number of candidates, Actual the number of matches.
+	Estimated int
+	Actual    int
+}
+
+func (p *Plan) addClause(c ClausePlan) {
+	if p == nil {
+		return
+	}
+	p.Clauses = append(p.Clauses, c)
+	p.FullScan = p.FullScan || c.FullScan
+}
+
+// Explain runs a query like Find, or like ReadAll if there are no where
+// clauses, expressions or filters, without returning the resources and
+// returns its plan. A query matching nothing isn't an error.
+func (dir Directory) Explain(resource interface{}, options ...QueryOption) (*Plan, error) {
+	plan := &Plan{}
+	callback := func(resource interface{}) {}
+	q := dir.newQueryWithoutID("explain", resource)
+	q.ApplyOptions(options)
+	var err error
+	if len(q.WhereClauses) == 0 && len(q.Exprs) == 0 && len(q.Filters) == 0 {
+		err = dir.readAllCB(resource, callback, options, plan)
+	} else {
+		err = dir.findCB(resource, callback, options, plan)
+	}
+	if errors.Is(err, ErrNoMatches) {
+		err = nil
+	}
+	return plan, err
+}
+
+// StartPlan makes the query record its plan in plan, or in a new plan if
+// plan is nil and the directory reports slow queries.
+func (q *Query) StartPlan(plan *Plan) {
+	if plan == nil && q.Dir.slowQueryThreshold > 0 && q.Dir.slowQueryCallback != nil {
+		plan = &Plan{}
+	}
+	if plan != nil {
+		plan.Operation = q.Operation
+		plan.start = time.Now()
+	}
+	q.plan = plan
+}
+
+// FinishPlan completes the query's plan and reports it to the directory's
+// slow query callback if the query took at least the slow query threshold.
+func (q *Query) FinishPlan() {
+	if q.plan == nil {
+		return
+	}
+	q.plan.Model = q.Model
+	q.plan.Returned = len(q.MatchedIDs)
+	q.plan.Duration = time.Since(q.plan.start)
+	if q.Dir.slowQueryThreshold > 0 && q.Dir.slowQueryCallback != nil && q.plan.Duration >= q.Dir.slowQueryThreshold {
+		q.Dir.slowQueryCallback(*q.plan)
+	}
+}
+
+// since adds the time passed since start to d.
+func since(start time.Time, d *time.Duration) {
+	*d += time.Since(start)
+}
+
+// indexName names the index a link of an indexed chain is looked up in.
+func indexName(resourceType reflect.Type, link Where) string {
+	if isCompositeField(link.Field) {
+		return "composite:" + link.Field[1:]
+	}
+	name := link.Field
+	if fp, err := lookupField(resourceType, link.Field); err == nil {
+		name = fp.name
+	}
+	switch {
+	case link.Match != "":
+		return "fulltext:" + name
+	case link.isStringMatch() || link.isRange():
+		return "sorted:" + name
+	}
+	return "hash:" + name
+}
+
+// indexNames names the indexes a chain of indexed clauses is looked up in.
+func indexNames(resourceType reflect.Type, indexed *Where) (names []string) {
+	for c := indexed; c != nil; c = c.And {
+		names = append(names, indexName(resourceType, *c))
+	}
+	return
+}
+
+// describe describes a chain of ANDed clauses, e.g. `Status = active AND
+// Age >= 18`.
+func (clause Where) describe() string {
+	links := []string{}
+	for c := &clause; c != nil; c = c.And {
+		links = append(links, c.describeLink())
+	}
+	return strings.Join(links, " AND ")
+}
+
+func (clause Where) describeLink() string {
+	parts := []string{}
+	field := clause.Field
+	switch {
+	case field == "":
+	case clause.Match != "":
+		parts = append(parts, fmt.Sprintf("%s MATCH %q", field, clause.Match))
+	case clause.isStringMatch():
+		if clause.Prefix != "" {
+			parts = append(parts, fmt.Sprintf("%s PREFIX %q", field, clause.Prefix))
+		}
+		if clause.Suffix != "" {
+			parts = append(parts, fmt.Sprintf("%s SUFFIX %q", field, clause.Suffix))
+		}
+		if clause.EqualFold != "" {
+			parts = append(parts, fmt.Sprintf("%s EQUALFOLD %q", field, clause.EqualFold))
+		}
+	case clause.isRange():
+		if len(clause.Between) == 2 {
+			parts = append(parts, fmt.Sprintf("%s BETWEEN %v AND %v", field, clause.Between[0], clause.Between[1]))
+		} else if len(clause.Between) > 0 {
+			parts = append(parts, fmt.Sprintf("%s BETWEEN %v", field, clause.Between))
+		}
+		for _, op := range []struct {
+			symbol string
+			value  interface{}
+		}{{">", clause.Gt}, {">=", clause.Gte}, {"<", clause.Lt}, {"<=", clause.Lte}} {
+			if op.value != nil {
+				parts = append(parts, fmt.Sprintf("%s %s %v", field, op.symbol, op.value))
+			}
+		}
+	case len(clause.Range) > 0:
+		parts = append(parts, fmt.Sprintf("%s IN %v", field, clause.Range))
+	case len(clause.In) > 0:
+		parts = append(parts, fmt.Sprintf("%s IN %v", field, clause.In))
+	default:
+		parts = append(parts, fmt.Sprintf("%s = %v", field, clause.Equals))
+	}
+	if clause.Filter != nil {
+		parts = append(parts, "FILTER")
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// describeWheres describes clauses ANDed with each other.
+func describeWheres(clauses []Where) string {
+	described := []string{}
+	for _, clause := range clauses {
+		described = append(described, clause.describe())
+	}
+	return strings.Join(described, " AND ")
+}
+
+// describeExpr describes an expression, e.g. `(Status = active OR Status =
+// trial) AND NOT Banned = true`.
+func describeExpr(expr Expr) string {
+	join := func(exprs []Expr, op string) string {
+		described := []string{}
+		for _, e := range exprs {
+			d := describeExpr(e)
+			if len(exprs) > 1 && !isSimpleExpr(e) {
+				d = "(" + d + ")"
+			}
+			described = append(described, d)
+		}
+		return strings.Join(described, " "+op+" ")
+	}
+	switch e := expr.(type) {
+	case Where:
+		return e.describe()
+	case andExpr:
+		return join(e, "AND")
+	case orExpr:
+		return join(e, "OR")
+	case notExpr:
+		if isSimpleExpr(e.expr) {
+			return "NOT " + describeExpr(e.expr)
+		}
+		return "NOT (" + describeExpr(e.expr) + ")"
+	}
+	return ""
+}
+
+// isSimpleExpr reports whether an expression is described without operators
+// which would need parentheses when nested.
+func isSimpleExpr(expr Expr) bool {
+	switch e := expr.(type) {
+	case Where:
+		return !strings.Contains(e.describe(), " AND ")
+	case notExpr:
+		return isSimpleExpr(e.expr)
+	}
+	return false
+}
@@ -3,19 +3,15 @@ package gorialize
 
 import (
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
 	"encoding/gob"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Query struct {
@@ -31,21 +27,53 @@ type Query struct {
 	Counter      int
 	CounterPath  string
 	MetadataPath string
+	FileLock     *fileLock
 	ResourcePath string
 	DirPath      string
 	SafeIOPath   bool
 	DirFileInfo  []os.FileInfo
 	WhereClauses []Where
 	MatchedIDs   []int
+	Groups       map[string]Aggregate
 	IndexUpdates []string
+	Order        *Order
+	Limit        int
+	Offset       int
+	Cursor       string
+	NextCursor   *string
+	Exprs        []Expr
+	Filters      []func(resource interface{}) bool
+	Reader       func(resource interface{}, id int) error
+	sorted       []sortedEntry
+	orderKind    orderKind
+	universe     idSet
+	plan         *Plan
 }
 
+// Where clauses are passed to Find() and can be ANDed by being chained via
+// Where#And. Gt, Gte, Lt, Lte and Between compare ordered fields, i.e.
+// numbers, strings and time.Time, and are answered from a sorted index.
+// Clauses on fields which aren't indexed and Filter predicates are evaluated
+// on the decoded resources which the clause's indexed fields narrowed down to,
+// or on all resources of the model if there are none. Prefix, Suffix and
+// EqualFold compare string fields. Match queries terms of fulltext fields, see
+// parseMatch.
 type Where struct {
-	Field  string
-	Equals interface{}
-	In     []interface{}
-	Range  []int
-	And    *Where
+	Field     string
+	Equals    interface{}
+	In        []interface{}
+	Range     []int
+	Gt        interface{}
+	Gte       interface{}
+	Lt        interface{}
+	Lte       interface{}
+	Between   []interface{}
+	Prefix    string
+	Suffix    string
+	EqualFold string
+	Match     string
+	Filter    func(resource interface{}) bool
+	And       *Where
 }
 
 func (q Query) Log() {
@@ -63,6 +91,22 @@ func (q Query) Log() {
 	}
 }
 
+// Err returns the query's fatal error wrapped in a *QueryError, or nil.
+func (q *Query) Err() error {
+	if q.FatalError == nil {
+		return nil
+	}
+	if _, ok := q.FatalError.(*QueryError); ok {
+		return q.FatalError
+	}
+	return &QueryError{
+		Op:    q.Operation,
+		Model: q.Model,
+		ID:    q.ID,
+		Err:   q.FatalError,
+	}
+}
+
 func (q *Query) ReflectTypeOfResource() {
 	if q.FatalError != nil {
 		return
@@ -98,42 +142,10 @@ func (q *Query) UpdateIndex(operator rune) {
 		q.FatalError = errors.New("Resource type missing")
 		return
 	}
-	f, err := os.OpenFile(q.Dir.IndexLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		q.FatalError = err
-		return
-	}
-	defer f.Close()
-
-	for i := 0; i < q.ResourceType.Elem().NumField(); i++ {
-		field := q.ResourceType.Elem().Field(i)
-		tag := field.Tag.Get("gorialize")
-		if tag == "indexed" {
-			value := reflect.Indirect(
-				reflect.ValueOf(q.Resource),
-			).FieldByName(field.Name).Interface()
-
-			if operator == '-' || operator == 'x' {
-				logEntry := fmt.Sprintf("-%s:%s:%d", q.Model, field.Name, q.ID)
-				_, err = f.WriteString(logEntry + "\n")
-				if err != nil {
-					q.FatalError = err
-					return
-				}
-				q.Dir.Index.remove(q.Model, field.Name, q.ID)
-				q.IndexUpdates = append(q.IndexUpdates, logEntry)
-			}
-			if operator == '+' || operator == 'x' {
-				logEntry := fmt.Sprintf("+%s:%s:%v=%d", q.Model, field.Name, value, q.ID)
-				_, err = f.WriteString(logEntry + "\n")
-				if err != nil {
-					q.FatalError = err
-					return
-				}
-				q.Dir.Index.add(q.Model, field.Name, value, q.ID)
-				q.IndexUpdates = append(q.IndexUpdates, logEntry)
-			}
-		}
+	logEntries := indexLogEntries(q.Model, q.ResourceType, q.Resource, q.ID, operator)
+	q.FatalError = q.Dir.updateIndex(logEntries)
+	if q.FatalError == nil {
+		q.IndexUpdates = append(q.IndexUpdates, logEntries...)
 	}
 }
 
@@ -149,7 +161,7 @@ func (q *Query) BuildDirPath() {
 		q.FatalError = errors.New("Model name missing")
 		return
 	}
-	q.DirPath = q.Dir.Path + "/" + q.Model
+	q.DirPath = q.Dir.Path + "/" + q.Dir.modelDirName(q.Model)
 }
 
 func (q *Query) BuildCustomDirPath(subdir string) {
@@ -187,6 +199,31 @@ func (q *Query) CreateMetadataDirectoryIfNotExist() {
 	}
 }
 
+// LockFile takes the model's cross-process write lock. It must be released
+// with UnlockFile once the query is done.
+func (q *Query) LockFile() {
+	if q.FatalError != nil {
+		return
+	}
+	if !q.SafeIOPath {
+		q.FatalError = errors.New("IO path not marked as safe")
+		return
+	}
+	if q.MetadataPath == "" {
+		q.FatalError = errors.New("Metadata path missing")
+		return
+	}
+	q.FileLock, q.FatalError = lockFile(q.MetadataPath+"/lock", true, true)
+}
+
+func (q *Query) UnlockFile() {
+	err := q.FileLock.unlock()
+	q.FileLock = nil
+	if q.FatalError == nil {
+		q.FatalError = err
+	}
+}
+
 func (q *Query) BuildCounterPath() {
 	if q.FatalError != nil {
 		return
@@ -227,11 +264,24 @@ func (q *Query) ReadCounterFromDisk() {
 		return
 	}
 	b, err := readFromDisk(q.CounterPath)
-	if err == nil {
-		q.Counter, q.FatalError = strconv.Atoi(string(b))
-	} else {
+	if err != nil {
 		q.Counter = 0
+		return
+	}
+	counter, err := q.Dir.unseal(b)
+	if errors.Is(err, ErrDecrypt) && q.Dir.plaintextAllowed() {
+		// Counters of directories encrypted before their metadata was are
+		// plaintext until the directory is opened again, as are those of
+		// directories being encrypted by Rekey.
+		if _, atoiErr := strconv.Atoi(string(b)); atoiErr == nil {
+			counter, err = b, nil
+		}
+	}
+	if err != nil {
+		q.FatalError = err
+		return
 	}
+	q.Counter, q.FatalError = strconv.Atoi(string(counter))
 }
 
 func (q *Query) IncrementCounterAndSetID() {
@@ -292,7 +342,12 @@ func (q *Query) WriteCounterToDisk() {
 		q.FatalError = errors.New("Counter path missing")
 		return
 	}
-	q.FatalError = writeToDisk(q.CounterPath, []byte(strconv.Itoa(q.Counter)))
+	var b []byte
+	b, q.FatalError = q.Dir.seal([]byte(strconv.Itoa(q.Counter)))
+	if q.FatalError != nil {
+		return
+	}
+	q.FatalError = writeToDisk(q.CounterPath, b)
 }
 
 func (q *Query) ExitIfDirNotExist() {
@@ -304,7 +359,7 @@ func (q *Query) ExitIfDirNotExist() {
 		return
 	}
 	if _, err := os.Stat(q.DirPath); os.IsNotExist(err) {
-		q.FatalError = errors.New("Directory does not exist")
+		q.FatalError = ErrModelDirMissing
 	}
 }
 
@@ -317,7 +372,7 @@ func (q *Query) ExitIfResourceNotExist() {
 		return
 	}
 	if _, err := os.Stat(q.ResourcePath); os.IsNotExist(err) {
-		q.FatalError = errors.New("Resource does not exist")
+		q.FatalError = ErrNotFound
 	}
 }
 
@@ -333,7 +388,13 @@ func (q *Query) ReadGobFromDisk() {
 		q.FatalError = errors.New("Resource path missing")
 		return
 	}
+	if q.plan != nil {
+		defer since(time.Now(), &q.plan.ReadTime)
+	}
 	q.GobBuffer, q.FatalError = readFromDisk(q.ResourcePath)
+	if os.IsNotExist(q.FatalError) {
+		q.FatalError = ErrNotFound
+	}
 }
 
 func (q *Query) DecodeGobToResource() {
@@ -344,6 +405,10 @@ func (q *Query) DecodeGobToResource() {
 		q.FatalError = errors.New("Gob buffer empty")
 		return
 	}
+	if q.plan != nil {
+		defer since(time.Now(), &q.plan.DecodeTime)
+		q.plan.Decoded++
+	}
 	reader := bytes.NewReader(q.GobBuffer)
 	dec := gob.NewDecoder(reader)
 	q.FatalError = dec.Decode(q.Resource)
@@ -384,25 +449,25 @@ func (q *Query) DeleteFromDisk() {
 		return
 	}
 	q.FatalError = deleteFromDisk(q.ResourcePath)
+	if os.IsNotExist(q.FatalError) {
+		q.FatalError = ErrNotFound
+	}
 }
 
 func (q *Query) ThwartIOBasePathEscape() {
 	if q.FatalError != nil {
 		return
 	}
-	if !strings.HasPrefix(q.DirPath, q.Dir.Path) {
+	if !strings.HasPrefix(q.DirPath, q.Dir.Path) || strings.Contains(q.DirPath, "..") {
 		q.SafeIOPath = false
-		q.Log()
-		log.Fatal("Thwarted IO operation outside of ", q.Dir.Path)
-	}
-	if strings.Contains(q.DirPath, "..") {
-		q.SafeIOPath = false
-		q.Log()
-		log.Fatal("Thwarted IO operation with path containing '..'")
+		q.FatalError = &ErrPathEscape{Path: q.DirPath, BasePath: q.Dir.Path}
+		return
 	}
 	q.SafeIOPath = true
 }
 
+// EncryptGobBuffer encrypts the gob with the directory's key and binds it to
+// the resource's model and ID.
 func (q *Query) EncryptGobBuffer() {
 	if q.FatalError != nil {
 		return
@@ -418,24 +483,11 @@ func (q *Query) EncryptGobBuffer() {
 		q.FatalError = errors.New("Encryption key missing")
 		return
 	}
-	var block cipher.Block
-	block, q.FatalError = aes.NewCipher(q.Dir.Key[:])
-	if q.FatalError != nil {
-		return
-	}
-	var gcm cipher.AEAD
-	gcm, q.FatalError = cipher.NewGCM(block)
-	if q.FatalError != nil {
-		return
-	}
-	nonce := make([]byte, gcm.NonceSize())
-	_, q.FatalError = io.ReadFull(rand.Reader, nonce)
-	if q.FatalError != nil {
-		return
-	}
-	q.GobBuffer = gcm.Seal(nonce, nonce, q.GobBuffer, nil)
+	q.GobBuffer, q.FatalError = sealResource(q.Dir.Key, q.Dir.keyID, q.Model, q.ID, q.GobBuffer)
 }
 
+// DecryptGobBuffer decrypts the gob, failing with ErrTampered if it was
+// encrypted for another model or ID.
 func (q *Query) DecryptGobBuffer() {
 	if q.FatalError != nil {
 		return
@@ -447,28 +499,20 @@ func (q *Query) DecryptGobBuffer() {
 		q.FatalError = errors.New("Decryption key missing")
 		return
 	}
-	var block cipher.Block
-	block, q.FatalError = aes.NewCipher(q.Dir.Key[:])
-	if q.FatalError != nil {
-		return
-	}
-	var gcm cipher.AEAD
-	gcm, q.FatalError = cipher.NewGCM(block)
-	if q.FatalError != nil {
-		return
+	if q.plan != nil {
+		defer since(time.Now(), &q.plan.DecryptTime)
 	}
-	if len(q.GobBuffer) < gcm.NonceSize() {
-		q.FatalError = errors.New("Gob buffer smaller than nonce")
-		return
+	var plaintext []byte
+	plaintext, q.FatalError = q.Dir.openResource(q.Model, q.ID, q.GobBuffer)
+	if q.FatalError != nil && q.Dir.isPlaintextResource(q.GobBuffer, q.FatalError) {
+		// Not yet encrypted or already decrypted by an interrupted Rekey.
+		plaintext, q.FatalError = q.GobBuffer, nil
 	}
-	q.GobBuffer, q.FatalError = gcm.Open(
-		nil,
-		q.GobBuffer[:gcm.NonceSize()],
-		q.GobBuffer[gcm.NonceSize():],
-		nil,
-	)
+	q.GobBuffer = plaintext
 }
 
+// ApplyWhereClauses matches the IDs of the resources matching any of the
+// query's where clauses and expressions and all of its filters.
 func (q *Query) ApplyWhereClauses() {
 	if q.FatalError != nil {
 		return
@@ -477,12 +521,61 @@ func (q *Query) ApplyWhereClauses() {
 		q.FatalError = errors.New("Model name missing")
 		return
 	}
-	if len(q.WhereClauses) == 0 {
+	if len(q.WhereClauses) == 0 && len(q.Exprs) == 0 && len(q.Filters) == 0 {
 		q.FatalError = errors.New("Where clauses missing")
 		return
 	}
-	q.MatchedIDs = q.Dir.Index.getMatchingIDs(q.Model, q.WhereClauses...)
+	q.FatalError = q.checkWhereFields()
+	if q.FatalError != nil {
+		return
+	}
+	if len(q.Exprs) > 0 {
+		q.applyExprs()
+		if q.FatalError == nil && len(q.MatchedIDs) == 0 {
+			q.FatalError = ErrNoMatches
+		}
+		return
+	}
+	clauses := q.WhereClauses
+	if len(clauses) == 0 {
+		clauses = []Where{{}}
+	}
+	matched := map[int]bool{}
+	for _, clause := range clauses {
+		if q.FatalError != nil {
+			return
+		}
+		indexed, residual := q.planWhere(clause)
+		var ids []int
+		if indexed != nil {
+			ids, q.FatalError = q.Dir.Index.getMatchingIDs(q.Model, q.ResourceType, *indexed)
+		} else {
+			ids, q.FatalError = q.allIDs()
+		}
+		step := ClausePlan{
+			Clause:    clause.describe(),
+			Indexes:   indexNames(q.ResourceType, indexed),
+			FullScan:  indexed == nil,
+			Estimated: len(ids),
+		}
+		if q.FatalError == nil && len(residual) > 0 {
+			step.Scan = describeWheres(residual)
+			ids, q.FatalError = q.filterIDs(ids, residual)
+		}
+		step.Actual = len(ids)
+		q.plan.addClause(step)
+		for _, id := range ids {
+			matched[id] = true
+		}
+	}
+	if q.FatalError != nil {
+		return
+	}
+	q.MatchedIDs = q.MatchedIDs[:0]
+	for id := range matched {
+		q.MatchedIDs = append(q.MatchedIDs, id)
+	}
 	if len(q.MatchedIDs) == 0 {
-		q.FatalError = errors.New("No matching where clauses")
+		q.FatalError = ErrNoMatches
 	}
 }
@@ -15,7 +15,7 @@ func getID(resource interface{}) (int, error) {
 
 	idField := val.FieldByName("ID")
 	if !idField.IsValid() || !idField.CanSet() || idField.Kind() != reflect.Int {
-		return 0, errors.New("resource does not have an addressable ID int field")
+		return 0, ErrNoIDField
 	}
 	return int(idField.Int()), nil
 }
@@ -28,7 +28,7 @@ func setID(resource interface{}, id int) error {
 
 	idField := val.FieldByName("ID")
 	if !idField.IsValid() || !idField.CanSet() || idField.Kind() != reflect.Int {
-		return errors.New("resource does not have an addressable ID int field")
+		return ErrNoIDField
 	}
 	idField.SetInt(int64(id))
 	return nil
@@ -0,0 +1,449 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Rekeying states recorded in the key parameters of a directory while it is
+// rekeyed. While it is encrypted or decrypted, its resources, counters and
+// schemas can be in plaintext.
+const (
+	rekeyRotate  = "rotate"
+	rekeyEncrypt = "encrypt"
+	rekeyDecrypt = "decrypt"
+)
+
+// RekeyProgress reports how many of a directory's resources Rekey has
+// processed so far.
+type RekeyProgress struct {
+	Model string
+	Done  int
+	Total int
+}
+
+// Rekey re-encrypts the resources, counters, schemas and index of the
+// directory with a key derived from newPassphrase and a new random salt. A
+// plaintext directory is encrypted and an empty newPassphrase decrypts the
+// directory. The progress callbacks are called after each resource.
+//
+// The new key is recorded before any file is rewritten, together with the
+// previous keys wrapped with it, so that an interrupted Rekey can be resumed
+// by opening the directory with the new passphrase, or the old one when
+// decrypting, and calling Rekey again with the same newPassphrase. Meanwhile
+// resources of either key can be read. No other queries may run on dir
+// meanwhile. The previous keys are kept after Rekey returns, so that what
+// other processes write before they reopen the directory can still be read,
+// until they are dropped by PruneKeys.
+func (dir *Directory) Rekey(newPassphrase string, progress ...func(p RekeyProgress)) error {
+	if newPassphrase == "" {
+		return dir.RekeyWith(nil, progress...)
+	}
+	return dir.RekeyWith(StaticPassphrase(newPassphrase), progress...)
+}
+
+// RekeyWith is like Rekey but asks the key provider for the new key or
+// passphrase. A nil key provider decrypts the directory.
+func (dir *Directory) RekeyWith(keys KeyProvider, progress ...func(p RekeyProgress)) error {
+	if dir.Path == "" {
+		return &QueryError{Op: "rekey", Err: errors.New("Directory path missing")}
+	}
+	var next *KeyMaterial
+	if keys != nil {
+		material, err := keys.ProvideKey()
+		if err != nil {
+			return &QueryError{Op: "rekey", Err: err}
+		}
+		next = &material
+	}
+	err := dir.rekey(next, progress)
+	if err != nil {
+		return &QueryError{Op: "rekey", Err: err}
+	}
+	return nil
+}
+
+// rekey rekeys the directory with the next key material or decrypts it if
+// next is nil.
+func (dir *Directory) rekey(next *KeyMaterial, progress []func(p RekeyProgress)) error {
+	err := os.MkdirAll(dir.Path, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	l, err := lockFile(keyParamsPath(dir.Path)+".lock", true, true)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	params, err := readKeyParams(dir.Path)
+	if os.IsNotExist(err) {
+		params, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	if params != nil && !dir.Encrypted {
+		return errors.New("Directory has key parameters and must be opened with its passphrase")
+	}
+	if params == nil && next == nil {
+		return nil
+	}
+	if params != nil && params.ObfuscateModels && next == nil {
+		return errors.New("Directory with obfuscated model names can't be decrypted")
+	}
+	// Fails before anything is written if a model can't be rekeyed.
+	_, err = dir.modelNames()
+	if err != nil {
+		return err
+	}
+
+	params, err = dir.startRekey(params, next)
+	if err != nil {
+		return err
+	}
+	decrypting := params.Rekeying == rekeyDecrypt
+	err = dir.rekeyModels(decrypting, progress)
+	if err != nil {
+		return err
+	}
+	err = dir.rekeyIndex(decrypting)
+	if err != nil {
+		return err
+	}
+	if decrypting {
+		return deleteFromDisk(keyParamsPath(dir.Path))
+	}
+	params.Rekeying = ""
+	return writeKeyParams(dir.Path, params)
+}
+
+// PruneKeys drops the previous keys Rekey keeps in the directory's keyring,
+// after re-encrypting what other processes still using them wrote since.
+// Call it once every process has reopened the directory, since whatever is
+// written with a pruned key can't be read anymore.
+func (dir *Directory) PruneKeys() error {
+	if dir.Path == "" {
+		return &QueryError{Op: "prune keys", Err: errors.New("Directory path missing")}
+	}
+	err := dir.pruneKeys()
+	if err != nil {
+		return &QueryError{Op: "prune keys", Err: err}
+	}
+	return nil
+}
+
+func (dir *Directory) pruneKeys() error {
+	l, err := lockFile(keyParamsPath(dir.Path)+".lock", true, true)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	params, err := readKeyParams(dir.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !dir.Encrypted || !hmac.Equal(params.Check, keyCheck(dir.Key)) {
+		return errors.New("Directory must be opened with its current passphrase")
+	}
+	if params.Rekeying != "" {
+		return errors.New("Directory is being rekeyed, resume Rekey first")
+	}
+	if len(params.Keyring) == 0 {
+		return nil
+	}
+
+	err = dir.rekeyModels(false, nil)
+	if err != nil {
+		return err
+	}
+	err = dir.rekeyIndex(false)
+	if err != nil {
+		return err
+	}
+	params.Keyring = nil
+	err = writeKeyParams(dir.Path, params)
+	if err != nil {
+		return err
+	}
+	dir.oldKeys = nil
+	return nil
+}
+
+// startRekey records the key parameters of the new key, unless the next key
+// material is the current key because an interrupted Rekey is resumed, and
+// makes the new key the directory's key while keeping the previous ones for
+// reading.
+func (dir *Directory) startRekey(params *keyParams, material *KeyMaterial) (*keyParams, error) {
+	converting := params == nil || params.Rekeying == rekeyEncrypt || params.Rekeying == rekeyDecrypt
+	if material == nil {
+		params.Rekeying = rekeyDecrypt
+		dir.converting = true
+		return params, writeKeyParams(dir.Path, params)
+	}
+	if params != nil && params.Rekeying != rekeyDecrypt {
+		key, err := material.deriveKey(*params)
+		if err == nil && hmac.Equal(params.Check, keyCheck(key)) {
+			return params, nil
+		}
+	}
+
+	kdf := KDFScrypt
+	switch {
+	case material.Key != nil:
+		kdf = kdfRaw
+	case params != nil && params.KDF != kdfRaw:
+		kdf = params.KDF
+	}
+	next, err := newKeyParams(kdf)
+	if err != nil {
+		return nil, err
+	}
+	key, err := material.deriveKey(*next)
+	if err != nil {
+		return nil, err
+	}
+	next.Check = keyCheck(key)
+	next.Sealed = true
+	next.Bound = true
+	next.Rekeying = rekeyRotate
+	if converting {
+		next.Rekeying = rekeyEncrypt
+	}
+	oldKeys := map[uint32]*[32]byte{}
+	if params != nil {
+		oldKeys[params.KeyID] = dir.Key
+		for id, oldKey := range dir.oldKeys {
+			oldKeys[id] = oldKey
+		}
+		for id := range oldKeys {
+			if id >= next.KeyID {
+				next.KeyID = id + 1
+			}
+			wrapped, err := wrapKey(key, oldKeys[id][:])
+			if err != nil {
+				return nil, err
+			}
+			next.Keyring = append(next.Keyring, wrappedKey{ID: id, Key: wrapped})
+		}
+		sort.Slice(next.Keyring, func(i, j int) bool { return next.Keyring[i].ID < next.Keyring[j].ID })
+		if params.ObfuscateModels {
+			next.ObfuscateModels = true
+			next.ModelKey, err = wrapKey(key, dir.modelKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = writeKeyParams(dir.Path, next)
+	if err != nil {
+		return nil, err
+	}
+	dir.Encrypted = true
+	dir.Key = key
+	dir.keyID = next.KeyID
+	dir.oldKeys = oldKeys
+	dir.converting = converting
+	dir.sealed = true
+	return next, nil
+}
+
+// rekeyModels re-encrypts or decrypts the resources, counters and schemas of
+// every model directory. Resources already encrypted with the directory's
+// key, or already decrypted, are skipped.
+func (dir Directory) rekeyModels(decrypting bool, progress []func(p RekeyProgress)) error {
+	paths, err := dir.resourcePaths()
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	total := 0
+	for name, modelPaths := range paths {
+		names = append(names, name)
+		total += len(modelPaths)
+	}
+	sort.Strings(names)
+
+	done := 0
+	for _, name := range names {
+		metadataPath := dir.Path + "/" + name + "/metadata"
+		model, err := dir.modelName(name, len(paths[name]) > 0)
+		if err != nil {
+			return err
+		}
+		err = dir.rekeyModel(model, metadataPath, paths[name], decrypting, func() {
+			done++
+			for _, report := range progress {
+				report(RekeyProgress{Model: model, Done: done, Total: total})
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// modelNames returns the model names of the model directories by directory
+// name, see modelName.
+func (dir Directory) modelNames() (map[string]string, error) {
+	paths, err := dir.resourcePaths()
+	if err != nil {
+		return nil, err
+	}
+	models := map[string]string{}
+	for name, modelPaths := range paths {
+		models[name], err = dir.modelName(name, len(modelPaths) > 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return models, nil
+}
+
+// modelName returns the name of the model whose directory has the given name
+// as recorded in its schema, defaulting to the directory's name. If model
+// names are obfuscated, the directory's name is a hash the model name can't
+// be recovered from, so it fails for a directory with resources unless its
+// schema names the model it was hashed from.
+func (dir Directory) modelName(name string, hasResources bool) (string, error) {
+	model, _, err := dir.readSchema(dir.Path + "/" + name + "/metadata")
+	if model == "" || err != nil {
+		model = name
+	}
+	if dir.modelKey != nil && hasResources && dir.modelDirName(model) != name {
+		return "", fmt.Errorf("Model name of %s can't be recovered without its schema", name)
+	}
+	return model, nil
+}
+
+func (dir Directory) rekeyModel(model string, metadataPath string, paths []string, decrypting bool, processed func()) error {
+	defer dir.lockModel(model, true)()
+	err := os.MkdirAll(metadataPath, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	l, err := lockFile(metadataPath+"/lock", true, true)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	current := resourceHeader(dir.keyID)
+	for _, path := range paths {
+		b, err := readFromDisk(path)
+		if os.IsNotExist(err) {
+			processed()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !decrypting && len(b) >= len(current) && string(b[:len(current)]) == string(current) {
+			processed()
+			continue
+		}
+		id, _ := strconv.Atoi(filepath.Base(path))
+		plaintext, err := dir.openResource(model, id, b)
+		if err != nil && !dir.isPlaintextResource(b, err) {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		switch {
+		case err != nil && decrypting:
+			// Decrypted before an interruption.
+			b = nil
+		case err != nil:
+			b, err = sealResource(dir.Key, dir.keyID, model, id, b)
+		case decrypting:
+			b = plaintext
+		default:
+			b, err = sealResource(dir.Key, dir.keyID, model, id, plaintext)
+		}
+		if err == nil && b != nil {
+			err = writeToDisk(path, b)
+		}
+		if err != nil {
+			return err
+		}
+		processed()
+	}
+
+	for _, path := range []string{metadataPath + "/counter", metadataPath + "/schema"} {
+		b, err := readFromDisk(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		plaintext, err := dir.unseal(b)
+		if err != nil && !(dir.converting && isPlaintextMetadata(path, b)) {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		switch {
+		case err != nil && decrypting:
+			continue
+		case err != nil:
+			b, err = encrypt(dir.Key, b, nil)
+		case decrypting:
+			b = plaintext
+		default:
+			b, err = encrypt(dir.Key, plaintext, nil)
+		}
+		if err == nil {
+			err = writeToDisk(path, b)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isPlaintextMetadata tells whether a counter or schema is in plaintext.
+func isPlaintextMetadata(path string, b []byte) bool {
+	if filepath.Base(path) == "schema" {
+		return json.Valid(b)
+	}
+	_, err := strconv.Atoi(string(b))
+	return err == nil
+}
+
+// rekeyIndex applies the entries other processes appended with the previous
+// keys and rewrites the index log and its snapshot with the directory's key,
+// or in plaintext when decrypting.
+func (dir *Directory) rekeyIndex(decrypting bool) error {
+	dir.Index.mutex.Lock()
+	defer dir.Index.mutex.Unlock()
+
+	l, err := lockFile(dir.IndexLogPath+".lock", true, true)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	err = dir.catchUpIndexLog()
+	if err != nil {
+		return err
+	}
+	if decrypting {
+		dir.Encrypted = false
+		dir.Key = nil
+		dir.keyID = 0
+		dir.oldKeys = nil
+		dir.sealed = false
+	}
+	dir.converting = false
+	return dir.compactIndex()
+}
@@ -0,0 +1,210 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+type filterOption func(resource interface{}) bool
+
+func (predicate filterOption) applyTo(q *Query) {
+	q.Filters = append(q.Filters, predicate)
+}
+
+// Filter is ANDed with the where clauses of a query. The predicate is called
+// with each decoded resource the where clauses matched, or with every
+// resource of the model if there are no where clauses.
+func Filter(predicate func(resource interface{}) bool) QueryOption {
+	return filterOption(predicate)
+}
+
+// planWhere splits a chain of ANDed clauses into a chain of clauses on
+// indexed fields, which narrows the candidates down using the index, and the
+// residual clauses and filters the candidates are scanned for. Equals clauses
+// covering all fields of a composite index are answered by a single lookup in
+// it. The indexed chain is nil if none of the fields is indexed.
+func (q *Query) planWhere(clause Where) (indexed *Where, residual []Where) {
+	indexed, residual = q.planChain(clause)
+	for _, filter := range q.Filters {
+		residual = append(residual, Where{Filter: filter})
+	}
+	return
+}
+
+// planChain is planWhere without the query's filters.
+func (q *Query) planChain(clause Where) (indexed *Where, residual []Where) {
+	links := []Where{}
+	for c := &clause; c != nil; c = c.And {
+		link := *c
+		link.And = nil
+		if link.Field != "" && link.Filter != nil {
+			residual = append(residual, Where{Filter: link.Filter})
+			link.Filter = nil
+		}
+		links = append(links, link)
+	}
+	for _, link := range useCompositeIndexes(q.ResourceType, links) {
+		if link.Field != "" && isIndexable(q.ResourceType, link) {
+			link := link
+			link.And = indexed
+			indexed = &link
+			continue
+		}
+		residual = append(residual, link)
+	}
+	return
+}
+
+// isIndexable reports whether a clause can be answered from the index: Match
+// clauses by the inverted index of fulltext fields, others by the index of
+// indexed fields.
+func isIndexable(resourceType reflect.Type, clause Where) bool {
+	if clause.Match != "" {
+		return isFulltextField(resourceType, clause.Field)
+	}
+	return isCompositeField(clause.Field) || isIndexedField(resourceType, clause.Field)
+}
+
+// checkWhereFields fails if a where clause refers to a field the resource
+// type doesn't have or compares it with a value which can't be converted to
+// the field's type.
+func (q *Query) checkWhereFields() error {
+	if q.ResourceType == nil {
+		return errors.New("Resource type missing")
+	}
+	clauses := append([]Where{}, q.WhereClauses...)
+	exprLeaves(q.Exprs, false, func(clause Where, negated bool) {
+		clauses = append(clauses, clause)
+	})
+	for _, clause := range clauses {
+		for c := &clause; c != nil; c = c.And {
+			if c.Field == "" {
+				continue
+			}
+			fp, err := lookupField(q.ResourceType, c.Field)
+			if err != nil {
+				return err
+			}
+			if c.Match != "" || c.isStringMatch() {
+				if fp.typ.Kind() != reflect.String {
+					return fmt.Errorf("Field %s of type %s can't be matched", c.Field, fp.typ)
+				}
+				if c.Match != "" {
+					_, err := parseMatch(c.Match)
+					if err != nil {
+						return fmt.Errorf("Field %s: %v", c.Field, err)
+					}
+				}
+				continue
+			}
+			if c.isRange() {
+				_, err := c.bounds(orderKindOf(fp.typ))
+				if err != nil {
+					return fmt.Errorf("Field %s: %v", c.Field, err)
+				}
+				continue
+			}
+			values := append([]interface{}{}, c.In...)
+			for _, value := range c.Range {
+				values = append(values, value)
+			}
+			if len(values) == 0 {
+				values = append(values, c.Equals)
+			}
+			for _, value := range values {
+				_, err := convertIndexValue(fp.typ, value)
+				if err != nil {
+					return fmt.Errorf("Field %s: %v", c.Field, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyFilters drops the matched IDs of resources not passing all of the
+// query's filters.
+func (q *Query) ApplyFilters() {
+	if q.FatalError != nil {
+		return
+	}
+	if len(q.Filters) == 0 {
+		return
+	}
+	residual := []Where{}
+	for _, filter := range q.Filters {
+		residual = append(residual, Where{Filter: filter})
+	}
+	step := ClausePlan{
+		Clause:    describeWheres(residual),
+		Scan:      describeWheres(residual),
+		FullScan:  len(q.WhereClauses) == 0 && len(q.Exprs) == 0,
+		Estimated: len(q.MatchedIDs),
+	}
+	q.MatchedIDs, q.FatalError = q.filterIDs(q.MatchedIDs, residual)
+	step.Actual = len(q.MatchedIDs)
+	q.plan.addClause(step)
+}
+
+// filterIDs decodes the resources with the given IDs and returns the IDs of
+// those matching all of the clauses.
+func (q *Query) filterIDs(ids []int, clauses []Where) (matched []int, err error) {
+	for _, id := range ids {
+		candidate := reflect.New(q.ResourceType.Elem()).Interface()
+		err = q.read(candidate, id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if q.matchesAll(candidate, clauses) {
+			matched = append(matched, id)
+		}
+	}
+	return matched, nil
+}
+
+func (q *Query) matchesAll(resource interface{}, clauses []Where) bool {
+	for _, clause := range clauses {
+		if !matchesWhere(q.Model, resource, clause) {
+			return false
+		}
+	}
+	return true
+}
+
+// matches reports whether a resource matches any of the query's where
+// clauses and expressions and all of its filters.
+func (q *Query) matches(resource interface{}) bool {
+	if len(q.Exprs) > 0 && !q.expr().matches(q.Model, resource) {
+		return false
+	}
+	if len(q.Exprs) == 0 && len(q.WhereClauses) > 0 && !matchesWhere(q.Model, resource, q.WhereClauses...) {
+		return false
+	}
+	for _, filter := range q.Filters {
+		if !filter(resource) {
+			return false
+		}
+	}
+	return true
+}
+
+// allIDs returns the IDs of all resources of the query's model.
+func (q *Query) allIDs() ([]int, error) {
+	r := q.Dir.newQueryWithoutID("read all", q.Resource)
+	r.ReflectTypeOfResource()
+	r.ReflectModelNameFromType()
+	r.BuildDirPath()
+	r.ThwartIOBasePathEscape()
+	r.ExitIfDirNotExist()
+	if r.FatalError == ErrModelDirMissing {
+		return nil, nil
+	}
+	r.ReadDirFileinfo()
+	r.MatchIDsFromDirFileinfo()
+	return r.MatchedIDs, r.FatalError
+}
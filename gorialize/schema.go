@@ -0,0 +1,246 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// schemaType describes a resource type well enough to decode its gobs and to
+// rebuild its index without access to the Go type, e.g. from the CLI.
+type schemaType struct {
+	// Model is the model name, recorded only for the resource type itself
+	// since directories may obfuscate model names.
+	Model  string        `json:"model,omitempty"`
+	Kind   string        `json:"kind"`
+	Len    int           `json:"len,omitempty"`
+	Key    *schemaType   `json:"key,omitempty"`
+	Elem   *schemaType   `json:"elem,omitempty"`
+	Fields []schemaField `json:"fields,omitempty"`
+}
+
+type schemaField struct {
+	Name     string      `json:"name"`
+	Type     *schemaType `json:"type"`
+	Tag      string      `json:"tag,omitempty"`
+	Embedded bool        `json:"embedded,omitempty"`
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+var basicTypes = map[string]reflect.Type{}
+
+func init() {
+	for _, v := range []interface{}{
+		false, "",
+		int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0), uintptr(0),
+		float32(0), float64(0), complex64(0), complex128(0),
+	} {
+		t := reflect.TypeOf(v)
+		basicTypes[t.Kind().String()] = t
+	}
+}
+
+// describeType returns the schema of t or nil if t can't be described, e.g.
+// because it is a func, chan or interface type.
+func describeType(t reflect.Type) *schemaType {
+	if t == timeType {
+		return &schemaType{Kind: "time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		elem := describeType(t.Elem())
+		if elem == nil {
+			return nil
+		}
+		return &schemaType{Kind: "ptr", Elem: elem}
+	case reflect.Slice, reflect.Array:
+		elem := describeType(t.Elem())
+		if elem == nil {
+			return nil
+		}
+		if t.Kind() == reflect.Array {
+			return &schemaType{Kind: "array", Len: t.Len(), Elem: elem}
+		}
+		return &schemaType{Kind: "slice", Elem: elem}
+	case reflect.Map:
+		key := describeType(t.Key())
+		elem := describeType(t.Elem())
+		if key == nil || elem == nil {
+			return nil
+		}
+		return &schemaType{Kind: "map", Key: key, Elem: elem}
+	case reflect.Struct:
+		s := &schemaType{Kind: "struct"}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			fieldType := describeType(field.Type)
+			if fieldType == nil {
+				continue
+			}
+			s.Fields = append(s.Fields, schemaField{
+				Name:     field.Name,
+				Type:     fieldType,
+				Tag:      string(field.Tag),
+				Embedded: field.Anonymous,
+			})
+		}
+		return s
+	}
+	if _, ok := basicTypes[t.Kind().String()]; ok {
+		return &schemaType{Kind: t.Kind().String()}
+	}
+	return nil
+}
+
+// reflectType returns a Go type which gobs of the described type decode into.
+func (s *schemaType) reflectType() (reflect.Type, error) {
+	switch s.Kind {
+	case "time":
+		return timeType, nil
+	case "ptr", "slice", "array":
+		if s.Elem == nil {
+			return nil, errors.New("Schema element type missing")
+		}
+		elem, err := s.Elem.reflectType()
+		if err != nil {
+			return nil, err
+		}
+		switch s.Kind {
+		case "ptr":
+			return reflect.PtrTo(elem), nil
+		case "slice":
+			return reflect.SliceOf(elem), nil
+		default:
+			return reflect.ArrayOf(s.Len, elem), nil
+		}
+	case "map":
+		if s.Key == nil || s.Elem == nil {
+			return nil, errors.New("Schema map type incomplete")
+		}
+		key, err := s.Key.reflectType()
+		if err != nil {
+			return nil, err
+		}
+		elem, err := s.Elem.reflectType()
+		if err != nil {
+			return nil, err
+		}
+		return reflect.MapOf(key, elem), nil
+	case "struct":
+		fields := []reflect.StructField{}
+		for _, f := range s.Fields {
+			if f.Type == nil {
+				return nil, errors.New("Schema field type missing")
+			}
+			t, err := f.Type.reflectType()
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, reflect.StructField{
+				Name:      f.Name,
+				Type:      t,
+				Tag:       reflect.StructTag(f.Tag),
+				Anonymous: f.Embedded && t.Kind() == reflect.Struct,
+			})
+		}
+		return reflect.StructOf(fields), nil
+	}
+	if t, ok := basicTypes[s.Kind]; ok {
+		return t, nil
+	}
+	return nil, errors.New("Unknown schema kind: " + s.Kind)
+}
+
+// writtenSchemas caches the schemas written by this process by schema path.
+var writtenSchemas sync.Map
+
+// WriteSchema records the resource type's schema in the model's metadata
+// directory so that tools like the CLI can rebuild the model's index.
+func (q *Query) WriteSchema() {
+	if q.FatalError != nil {
+		return
+	}
+	if !q.SafeIOPath {
+		q.FatalError = errors.New("Write path not marked as safe")
+		return
+	}
+	if q.MetadataPath == "" {
+		q.FatalError = errors.New("Metadata path missing")
+		return
+	}
+	if q.ResourceType == nil {
+		q.FatalError = errors.New("Resource type missing")
+		return
+	}
+	schema := describeType(q.ResourceType.Elem())
+	if schema != nil {
+		schema.Model = q.Model
+	}
+	var b []byte
+	b, q.FatalError = json.Marshal(schema)
+	if q.FatalError != nil {
+		return
+	}
+
+	path := q.MetadataPath + "/schema"
+	if written, ok := writtenSchemas.Load(path); ok && bytes.Equal(written.([]byte), b) {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+	}
+	existing, err := readFromDisk(path)
+	if err == nil {
+		existing, err = q.Dir.unseal(existing)
+	}
+	if err != nil || !bytes.Equal(existing, b) {
+		var sealed []byte
+		sealed, q.FatalError = q.Dir.seal(b)
+		if q.FatalError != nil {
+			return
+		}
+		q.FatalError = writeToDisk(path, sealed)
+		if q.FatalError != nil {
+			return
+		}
+	}
+	writtenSchemas.Store(path, b)
+}
+
+// readSchema returns the model name and pointer type described by a model's
+// schema file. The model name is empty for schemas written before it was
+// recorded.
+func (dir Directory) readSchema(metadataPath string) (string, reflect.Type, error) {
+	b, err := readFromDisk(metadataPath + "/schema")
+	if err != nil {
+		return "", nil, err
+	}
+	if !json.Valid(b) || !dir.plaintextAllowed() {
+		b, err = dir.unseal(b)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	s := &schemaType{}
+	err = json.Unmarshal(b, s)
+	if err != nil {
+		return "", nil, err
+	}
+	if s.Kind != "struct" {
+		return "", nil, errors.New("Schema does not describe a struct")
+	}
+	t, err := s.reflectType()
+	if err != nil {
+		return "", nil, err
+	}
+	return s.Model, reflect.PtrTo(t), nil
+}
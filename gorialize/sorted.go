@@ -0,0 +1,313 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// orderKind is the ordering used by a sorted index.
+type orderKind int
+
+const (
+	orderNone orderKind = iota
+	orderInt
+	orderUint
+	orderFloat
+	orderString
+	orderTime
+)
+
+// orderedValue holds an indexed value in the representation of its orderKind.
+type orderedValue struct {
+	i int64
+	u uint64
+	f float64
+	s string
+	t time.Time
+}
+
+// timeLayout is the layout time.Time index values are formatted with in UTC.
+const timeLayout = time.RFC3339Nano
+
+func orderKindOf(t reflect.Type) orderKind {
+	if t == timeType {
+		return orderTime
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return orderInt
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return orderUint
+	case reflect.Float32, reflect.Float64:
+		return orderFloat
+	case reflect.String:
+		return orderString
+	}
+	return orderNone
+}
+
+// parseOrdered parses a value formatted by formatIndexValue.
+func parseOrdered(kind orderKind, s string) (v orderedValue, err error) {
+	switch kind {
+	case orderInt:
+		v.i, err = strconv.ParseInt(s, 10, 64)
+	case orderUint:
+		v.u, err = strconv.ParseUint(s, 10, 64)
+	case orderFloat:
+		v.f, err = strconv.ParseFloat(s, 64)
+	case orderString:
+		v.s = s
+	case orderTime:
+		v.t, err = time.Parse(timeLayout, s)
+	default:
+		err = errors.New("Value can't be ordered")
+	}
+	return
+}
+
+// toOrdered converts a query value to the given orderKind.
+func toOrdered(kind orderKind, value interface{}) (orderedValue, error) {
+	if t, ok := value.(time.Time); ok && kind == orderTime {
+		return orderedValue{t: t}, nil
+	}
+	v, err := parseOrdered(kind, fmt.Sprint(value))
+	if err != nil {
+		return v, fmt.Errorf("Can't compare %v (%T) with indexed values: %v", value, value, err)
+	}
+	return v, nil
+}
+
+func compareOrdered(kind orderKind, a orderedValue, b orderedValue) int {
+	switch kind {
+	case orderInt:
+		return compareInts(a.i < b.i, a.i > b.i)
+	case orderUint:
+		return compareInts(a.u < b.u, a.u > b.u)
+	case orderFloat:
+		return compareInts(a.f < b.f, a.f > b.f)
+	case orderString:
+		return strings.Compare(a.s, b.s)
+	case orderTime:
+		return compareInts(a.t.Before(b.t), a.t.After(b.t))
+	}
+	return 0
+}
+
+func compareInts(less bool, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+// sortedEntry is an indexed value with the ID of the resource it belongs to.
+type sortedEntry struct {
+	value orderedValue
+	id    int
+}
+
+// sortedIndex keeps the indexed values of a model's field in order so that
+// range queries are answered by binary search.
+type sortedIndex struct {
+	kind    orderKind
+	entries []sortedEntry
+}
+
+func (si *sortedIndex) less(a sortedEntry, b sortedEntry) bool {
+	c := compareOrdered(si.kind, a.value, b.value)
+	return c < 0 || (c == 0 && a.id < b.id)
+}
+
+func (si *sortedIndex) equal(a sortedEntry, b sortedEntry) bool {
+	return a.id == b.id && compareOrdered(si.kind, a.value, b.value) == 0
+}
+
+func (si *sortedIndex) insert(e sortedEntry) {
+	i := sort.Search(len(si.entries), func(i int) bool {
+		return !si.less(si.entries[i], e)
+	})
+	if i < len(si.entries) && si.equal(si.entries[i], e) {
+		return
+	}
+	si.entries = append(si.entries, sortedEntry{})
+	copy(si.entries[i+1:], si.entries[i:])
+	si.entries[i] = e
+}
+
+func (si *sortedIndex) remove(e sortedEntry) {
+	i := sort.Search(len(si.entries), func(i int) bool {
+		return !si.less(si.entries[i], e)
+	})
+	if i < len(si.entries) && si.equal(si.entries[i], e) {
+		si.entries = append(si.entries[:i], si.entries[i+1:]...)
+	}
+}
+
+// bounds describes a range of values. A nil bound is unbounded.
+type bounds struct {
+	lower          *orderedValue
+	lowerInclusive bool
+	upper          *orderedValue
+	upperInclusive bool
+}
+
+// ids returns the IDs of all entries within the bounds.
+func (si *sortedIndex) ids(b bounds) (ids []int) {
+	start := 0
+	if b.lower != nil {
+		start = sort.Search(len(si.entries), func(i int) bool {
+			c := compareOrdered(si.kind, si.entries[i].value, *b.lower)
+			return c > 0 || (c == 0 && b.lowerInclusive)
+		})
+	}
+	end := len(si.entries)
+	if b.upper != nil {
+		end = sort.Search(len(si.entries), func(i int) bool {
+			c := compareOrdered(si.kind, si.entries[i].value, *b.upper)
+			return c > 0 || (c == 0 && !b.upperInclusive)
+		})
+	}
+	for i := start; i < end; i++ {
+		ids = append(ids, si.entries[i].id)
+	}
+	return
+}
+
+func (b bounds) contains(kind orderKind, v orderedValue) bool {
+	if b.lower != nil {
+		c := compareOrdered(kind, v, *b.lower)
+		if c < 0 || (c == 0 && !b.lowerInclusive) {
+			return false
+		}
+	}
+	if b.upper != nil {
+		c := compareOrdered(kind, v, *b.upper)
+		if c > 0 || (c == 0 && !b.upperInclusive) {
+			return false
+		}
+	}
+	return true
+}
+
+// isRange reports whether the clause uses a comparison operator.
+func (clause Where) isRange() bool {
+	return clause.Gt != nil || clause.Gte != nil || clause.Lt != nil || clause.Lte != nil || len(clause.Between) > 0
+}
+
+// bounds converts the clause's comparison operators to bounds of the given kind.
+func (clause Where) bounds(kind orderKind) (b bounds, err error) {
+	bound := func(value interface{}) (*orderedValue, error) {
+		v, err := toOrdered(kind, value)
+		return &v, err
+	}
+	if len(clause.Between) > 0 {
+		if len(clause.Between) != 2 {
+			return b, errors.New("Between takes exactly two values")
+		}
+		clause.Gte, clause.Lte = clause.Between[0], clause.Between[1]
+	}
+	if clause.Gt != nil {
+		b.lower, err = bound(clause.Gt)
+	}
+	if clause.Gte != nil && err == nil {
+		b.lower, err = bound(clause.Gte)
+		b.lowerInclusive = true
+	}
+	if clause.Lt != nil && err == nil {
+		b.upper, err = bound(clause.Lt)
+	}
+	if clause.Lte != nil && err == nil {
+		b.upper, err = bound(clause.Lte)
+		b.upperInclusive = true
+	}
+	return
+}
+
+// fieldOrderKind returns the orderKind of a resource type's field.
+func fieldOrderKind(resourceType reflect.Type, field string) (orderKind, error) {
+	if resourceType == nil {
+		return orderNone, errors.New("Resource type missing")
+	}
+	fp, err := lookupField(resourceType, field)
+	if err != nil {
+		return orderNone, err
+	}
+	kind := orderKindOf(fp.typ)
+	if kind == orderNone {
+		return orderNone, fmt.Errorf("Field %s of type %s can't be ordered", field, fp.typ)
+	}
+	return kind, nil
+}
+
+// sortedIndexFor returns the sorted index of a model's field, building it from
+// the index's keys the first time it is needed. The caller must hold at least
+// a read lock on the index.
+func (idx Index) sortedIndexFor(model string, field string, kind orderKind) (*sortedIndex, error) {
+	idx.sortedMutex.Lock()
+	defer idx.sortedMutex.Unlock()
+
+	name := model + ":" + field
+	if si, ok := idx.sorted[name]; ok {
+		if si.kind != kind {
+			return nil, fmt.Errorf("Field %s is indexed with a different type", field)
+		}
+		return si, nil
+	}
+
+	si := &sortedIndex{kind: kind}
+	prefix := name + ":"
+	for key, ids := range idx.KV {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		v, err := parseOrdered(kind, unescapeIndexValue(key[len(prefix):]))
+		if err != nil {
+			continue
+		}
+		for _, id := range ids {
+			si.entries = append(si.entries, sortedEntry{value: v, id: id})
+		}
+	}
+	sort.Slice(si.entries, func(i, j int) bool {
+		return si.less(si.entries[i], si.entries[j])
+	})
+	idx.sorted[name] = si
+	return si, nil
+}
+
+// updateSorted keeps an existing sorted index in sync with an added or
+// removed key. The caller must hold the index's write lock.
+func (idx Index) updateSorted(key string, id int, add bool) {
+	idx.sortedMutex.Lock()
+	defer idx.sortedMutex.Unlock()
+
+	if len(idx.sorted) == 0 {
+		return
+	}
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) != 3 {
+		return
+	}
+	si, ok := idx.sorted[parts[0]+":"+parts[1]]
+	if !ok {
+		return
+	}
+	v, err := parseOrdered(si.kind, unescapeIndexValue(parts[2]))
+	if err != nil {
+		return
+	}
+	if add {
+		si.insert(sortedEntry{value: v, id: id})
+	} else {
+		si.remove(sortedEntry{value: v, id: id})
+	}
+}
@@ -0,0 +1,126 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// lowered reports whether the field's values are indexed in lower case, i.e.
+// it is a string field tagged `gorialize:"indexed,lower"`.
+func (fp fieldPath) lowered() bool {
+	return fp.tag.lower && fp.typ.Kind() == reflect.String
+}
+
+// normalize lower cases a formatted value of a lowered field.
+func (fp fieldPath) normalize(s string) string {
+	if fp.lowered() {
+		return strings.ToLower(s)
+	}
+	return s
+}
+
+// indexValue returns the index key representation of one of the field's
+// values.
+func (fp fieldPath) indexValue(v reflect.Value) string {
+	return escapeIndexValue(fp.normalize(formatIndexValue(v)))
+}
+
+// encodeValue converts a query value to the field's type and returns its
+// index key representation.
+func (fp fieldPath) encodeValue(value interface{}) (string, error) {
+	v, err := convertIndexValue(fp.typ, value)
+	if err != nil {
+		return "", err
+	}
+	return fp.indexValue(v), nil
+}
+
+// isStringMatch reports whether the clause compares its field with Prefix,
+// Suffix or EqualFold.
+func (clause Where) isStringMatch() bool {
+	return clause.Prefix != "" || clause.Suffix != "" || clause.EqualFold != ""
+}
+
+// matchesString reports whether a string value matches all of the clause's
+// Prefix, Suffix and EqualFold operators.
+func (clause Where) matchesString(s string) bool {
+	return strings.HasPrefix(s, clause.Prefix) &&
+		strings.HasSuffix(s, clause.Suffix) &&
+		(clause.EqualFold == "" || strings.EqualFold(s, clause.EqualFold))
+}
+
+// normalizedFor lower cases the clause's string values if the field is
+// lowered, so that they are compared with the lower cased index values.
+func (clause Where) normalizedFor(fp fieldPath) Where {
+	if !fp.lowered() {
+		return clause
+	}
+	lower := func(value interface{}) interface{} {
+		if s, ok := value.(string); ok {
+			return strings.ToLower(s)
+		}
+		return value
+	}
+	clause.Equals = lower(clause.Equals)
+	clause.Gt = lower(clause.Gt)
+	clause.Gte = lower(clause.Gte)
+	clause.Lt = lower(clause.Lt)
+	clause.Lte = lower(clause.Lte)
+	in := make([]interface{}, len(clause.In))
+	for i, value := range clause.In {
+		in[i] = lower(value)
+	}
+	clause.In = in
+	between := make([]interface{}, len(clause.Between))
+	for i, value := range clause.Between {
+		between[i] = lower(value)
+	}
+	clause.Between = between
+	clause.Prefix = strings.ToLower(clause.Prefix)
+	clause.Suffix = strings.ToLower(clause.Suffix)
+	return clause
+}
+
+// stringIDs returns the IDs matching the clause's Prefix, Suffix and
+// EqualFold operators using the sorted index of the clause's field. Prefixes
+// and EqualFold on lowered fields are answered by binary search, other
+// operators check every value of the field.
+func (idx Index) stringIDs(model string, resourceType reflect.Type, clause Where) ([]int, error) {
+	fp, err := lookupField(resourceType, clause.Field)
+	if err != nil {
+		return nil, err
+	}
+	clause = clause.normalizedFor(fp)
+	si, err := idx.sortedIndexFor(model, fp.name, orderString)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := si.entries
+	narrow := func(prefix string, exact bool) {
+		start := sort.Search(len(entries), func(i int) bool {
+			return entries[i].value.s >= prefix
+		})
+		end := start + sort.Search(len(entries)-start, func(i int) bool {
+			s := entries[start+i].value.s
+			return !strings.HasPrefix(s, prefix) || exact && s != prefix
+		})
+		entries = entries[start:end]
+	}
+	if clause.Prefix != "" {
+		narrow(clause.Prefix, false)
+	}
+	if clause.EqualFold != "" && fp.lowered() {
+		narrow(strings.ToLower(clause.EqualFold), true)
+	}
+
+	ids := []int{}
+	for _, e := range entries {
+		if clause.matchesString(e.value.s) {
+			ids = append(ids, e.id)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,599 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Tx stages writes to several resources which are applied all-or-nothing by
+// Commit. IDs of created resources are reserved right away so that staged
+// resources can reference each other, e.g. through a 'FooID' owner field.
+// IDs reserved by a rolled back transaction are not reused.
+type Tx struct {
+	dir    Directory
+	writes []*txWrite
+	done   bool
+	mutex  sync.Mutex
+}
+
+// txWrite is a staged write. Later writes to the same resource are merged
+// into it, e.g. a replace after a create is still a create.
+type txWrite struct {
+	Operation       string
+	Model           string
+	ID              int
+	ResourceType    reflect.Type
+	DirPath         string
+	ResourcePath    string
+	GobBuffer       []byte
+	IndexLogEntries []string
+	Unique          []uniqueValue
+}
+
+// txJournal is written before a commit touches any resource so that an
+// interrupted commit can be rolled forward by OpenDirectory.
+type txJournal struct {
+	IndexLogGen     int
+	IndexLogSize    int64
+	Writes          []txJournalWrite
+	IndexLogEntries []string
+}
+
+type txJournalWrite struct {
+	DirPath      string
+	ResourcePath string
+	GobBuffer    []byte
+	Delete       bool
+}
+
+// Begin starts a new transaction.
+func (dir Directory) Begin() *Tx {
+	return &Tx{dir: dir}
+}
+
+// Create stages the creation of a new serialized resource and sets its ID.
+func (tx *Tx) Create(resource interface{}) error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	q := tx.dir.newQueryWithoutID("create", resource)
+	tx.exitIfDone(q)
+	q.ReflectTypeOfResource()
+	q.ReflectModelNameFromType()
+	q.BuildDirPath()
+	q.ThwartIOBasePathEscape()
+	tx.reserveID(q)
+	q.EncodeResourceToGob()
+	q.EncryptGobBuffer()
+	q.BuildResourcePath()
+	tx.stage(q)
+	q.Log()
+	return q.Err()
+}
+
+// Read reads the resource with the given ID as staged by the transaction or,
+// if the transaction doesn't touch it, as serialized in the directory.
+func (tx *Tx) Read(resource interface{}, id int) error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	return tx.read(resource, id)
+}
+
+func (tx *Tx) read(resource interface{}, id int) error {
+	w := tx.staged(modelOf(resource), id)
+	if w == nil {
+		return tx.dir.Read(resource, id)
+	}
+
+	q := tx.dir.newQueryWithID("read", resource, id)
+	q.ReflectTypeOfResource()
+	q.ReflectModelNameFromType()
+	if w.Operation == "delete" {
+		q.FatalError = ErrNotFound
+	}
+	q.GobBuffer = w.GobBuffer
+	q.DecryptGobBuffer()
+	q.DecodeGobToResource()
+	q.Log()
+	return q.Err()
+}
+
+// Find finds all resources of the given slice's element type matching any of
+// the provided WHERE clauses, including the transaction's staged writes, and
+// appends them to the slice.
+func (tx *Tx) Find(slice interface{}, options ...QueryOption) error {
+	slicePtr := reflect.ValueOf(slice)
+	sliceVal := reflect.Indirect(slicePtr)
+	resourceTyp := reflect.TypeOf(slice).Elem().Elem()
+	resourceVal := reflect.New(resourceTyp)
+	resource := resourceVal.Interface()
+
+	err := tx.FindCB(resource, func(resource interface{}) {
+		resourcePtr := reflect.ValueOf(resource)
+		resourceVal := reflect.Indirect(resourcePtr)
+		sliceVal.Set(reflect.Append(sliceVal, resourceVal))
+	}, options...)
+	return err
+}
+
+// FindCB finds all resources of the given type matching any of the provided
+// WHERE clauses, including the transaction's staged writes, and calls the
+// provided callback function on each.
+func (tx *Tx) FindCB(resource interface{}, callback func(resource interface{}), options ...QueryOption) error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	q := tx.dir.newQueryWithoutID("find all", resource)
+	q.Reader = tx.read
+	q.ApplyOptions(options)
+	q.ReflectTypeOfResource()
+	q.ReflectModelNameFromType()
+	q.RefreshIndex()
+	q.ApplyWhereClauses()
+	if q.FatalError == ErrNoMatches {
+		q.FatalError = nil
+	}
+	tx.applyStagedWritesToMatchedIDs(q)
+	q.SortMatchedIDs()
+	q.ApplyCursor()
+	q.PaginateMatchedIDs()
+	for _, id := range q.MatchedIDs {
+		if q.FatalError != nil {
+			break
+		}
+		q.ID = id
+		q.FatalError = tx.read(resource, id)
+		q.PassResourceToCallback(callback)
+	}
+	q.Log()
+	return q.Err()
+}
+
+// Replace stages the replacement of a serialized resource.
+func (tx *Tx) Replace(resource interface{}) error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	id, err := getID(resource)
+	if err != nil {
+		return &QueryError{Op: "replace", Err: err}
+	}
+	q := tx.dir.newQueryWithID("replace", resource, id)
+	tx.exitIfDone(q)
+	q.ReflectTypeOfResource()
+	q.ReflectModelNameFromType()
+	q.BuildDirPath()
+	q.ThwartIOBasePathEscape()
+	tx.exitIfResourceNotExist(q)
+	q.EncodeResourceToGob()
+	q.EncryptGobBuffer()
+	q.BuildResourcePath()
+	tx.stage(q)
+	q.Log()
+	return q.Err()
+}
+
+// Delete stages the deletion of a serialized resource.
+func (tx *Tx) Delete(resource interface{}) error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	id, err := getID(resource)
+	if err != nil {
+		return &QueryError{Op: "delete", Err: err}
+	}
+	q := tx.dir.newQueryWithID("delete", resource, id)
+	tx.exitIfDone(q)
+	q.ReflectTypeOfResource()
+	q.ReflectModelNameFromType()
+	q.BuildDirPath()
+	q.ThwartIOBasePathEscape()
+	tx.exitIfResourceNotExist(q)
+	q.BuildResourcePath()
+	tx.stage(q)
+	q.Log()
+	return q.Err()
+}
+
+// Rollback discards all staged writes.
+func (tx *Tx) Rollback() error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.done {
+		return &QueryError{Op: "rollback", Err: ErrTxDone}
+	}
+	tx.done = true
+	tx.writes = nil
+	return nil
+}
+
+// Commit applies all staged writes atomically. A journal of the writes is
+// persisted first, so that a commit interrupted by a crash is rolled forward
+// the next time the directory is opened. The in-memory index is updated only
+// after all writes succeeded.
+func (tx *Tx) Commit() error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.done {
+		return &QueryError{Op: "commit", Err: ErrTxDone}
+	}
+	tx.done = true
+	if len(tx.writes) == 0 {
+		return nil
+	}
+
+	journalMutex := locks.get(tx.dir.Path, ".journal")
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+
+	models := []string{}
+	modelLockPaths := []string{}
+	for _, w := range tx.writes {
+		err := os.MkdirAll(w.DirPath+"/metadata", os.ModePerm)
+		if err != nil {
+			return &QueryError{Op: "commit", Model: w.Model, ID: w.ID, Err: err}
+		}
+		models = append(models, w.Model)
+		modelLockPaths = append(modelLockPaths, w.DirPath+"/metadata/lock")
+	}
+	models = uniqueSorted(models)
+	for _, model := range models {
+		defer tx.dir.lockModel(model, true)()
+	}
+
+	lockPaths := []string{tx.dir.journalPath() + ".lock"}
+	lockPaths = append(lockPaths, uniqueSorted(modelLockPaths)...)
+	unlock, err := lockFiles(lockPaths)
+	if err != nil {
+		return &QueryError{Op: "commit", Err: err}
+	}
+	defer unlock()
+
+	journal := &txJournal{}
+	for _, w := range tx.writes {
+		journal.Writes = append(journal.Writes, txJournalWrite{
+			DirPath:      w.DirPath,
+			ResourcePath: w.ResourcePath,
+			GobBuffer:    w.GobBuffer,
+			Delete:       w.Operation == "delete",
+		})
+		journal.IndexLogEntries = append(journal.IndexLogEntries, w.IndexLogEntries...)
+	}
+
+	for _, w := range tx.writes {
+		if w.Operation == "create" {
+			continue
+		}
+		if _, err := os.Stat(w.ResourcePath); os.IsNotExist(err) {
+			return &QueryError{Op: "commit", Model: w.Model, ID: w.ID, Err: ErrNotFound}
+		}
+	}
+
+	// The index log's file lock is taken after the index mutex, as by
+	// updateIndex, so that commits and other writes don't deadlock.
+	tx.dir.Index.mutex.Lock()
+	defer tx.dir.Index.mutex.Unlock()
+
+	l, err := lockFile(tx.dir.IndexLogPath+".lock", true, true)
+	if err != nil {
+		return &QueryError{Op: "commit", Err: err}
+	}
+	defer l.unlock()
+
+	err = tx.dir.catchUpIndexLog()
+	if err == nil {
+		err = tx.checkUnique()
+	}
+	if err != nil {
+		return &QueryError{Op: "commit", Err: err}
+	}
+	journal.IndexLogGen = tx.dir.indexLog.gen
+	journal.IndexLogSize = tx.dir.indexLog.offset
+	var buf bytes.Buffer
+	var b []byte
+	var size int64
+	err = gob.NewEncoder(&buf).Encode(journal)
+	if err == nil {
+		b, err = tx.dir.seal(buf.Bytes())
+	}
+	if err == nil {
+		err = writeToDisk(tx.dir.journalPath(), b)
+	}
+	if err == nil {
+		size, err = tx.dir.applyJournal(journal)
+	}
+	if err == nil {
+		err = deleteFromDisk(tx.dir.journalPath())
+	}
+	if err != nil {
+		return &QueryError{Op: "commit", Err: err}
+	}
+	err = tx.dir.indexLogAppended(size, journal.IndexLogEntries)
+	if err != nil {
+		return &QueryError{Op: "commit", Err: err}
+	}
+	return nil
+}
+
+func (tx *Tx) exitIfDone(q *Query) {
+	if q.FatalError != nil {
+		return
+	}
+	if tx.done {
+		q.FatalError = ErrTxDone
+	}
+}
+
+// reserveID records the model's schema like Directory.Create, increments the
+// model's counter on disk and sets the resource's ID.
+func (tx *Tx) reserveID(q *Query) {
+	if q.FatalError != nil {
+		return
+	}
+	defer tx.dir.lockModel(q.Model, true)()
+
+	q.BuildMetadataPath()
+	q.CreateMetadataDirectoryIfNotExist()
+	q.LockFile()
+	q.WriteSchema()
+	q.BuildCounterPath()
+	q.ReadCounterFromDisk()
+	q.IncrementCounterAndSetID()
+	q.WriteCounterToDisk()
+	q.UnlockFile()
+}
+
+func (tx *Tx) exitIfResourceNotExist(q *Query) {
+	if q.FatalError != nil {
+		return
+	}
+	if w := tx.staged(q.Model, q.ID); w != nil {
+		if w.Operation == "delete" {
+			q.FatalError = ErrNotFound
+		}
+		return
+	}
+	defer tx.dir.lockModel(q.Model, false)()
+
+	q.ExitIfDirNotExist()
+	q.BuildResourcePath()
+	q.ExitIfResourceNotExist()
+}
+
+func (tx *Tx) staged(model string, id int) *txWrite {
+	for _, w := range tx.writes {
+		if w.Model == model && w.ID == id {
+			return w
+		}
+	}
+	return nil
+}
+
+// stage records the query's write, merging it with an earlier write to the
+// same resource.
+func (tx *Tx) stage(q *Query) {
+	if q.FatalError != nil {
+		return
+	}
+	w := tx.staged(q.Model, q.ID)
+	switch {
+	case w == nil:
+		w = &txWrite{
+			Operation: q.Operation,
+			Model:     q.Model,
+			ID:        q.ID,
+		}
+		tx.writes = append(tx.writes, w)
+	case q.Operation == "delete" && w.Operation == "create":
+		for i := range tx.writes {
+			if tx.writes[i] == w {
+				tx.writes = append(tx.writes[:i], tx.writes[i+1:]...)
+				break
+			}
+		}
+		return
+	case q.Operation == "delete":
+		w.Operation = "delete"
+	}
+
+	operator := map[string]rune{"create": '+', "replace": 'x', "delete": '-'}[w.Operation]
+	w.ResourceType = q.ResourceType
+	w.DirPath = q.DirPath
+	w.ResourcePath = q.ResourcePath
+	w.GobBuffer = append([]byte(nil), q.GobBuffer...)
+	w.IndexLogEntries = indexLogEntries(q.Model, q.ResourceType, q.Resource, q.ID, operator)
+	w.Unique = nil
+	if w.Operation != "delete" {
+		w.Unique = uniqueValues(q.Model, q.ResourceType, q.Resource)
+	}
+}
+
+// checkUnique fails with *ErrUniqueViolation if a staged resource has the
+// value of a unique field which another resource has, either in the index or
+// staged by the transaction. The caller must hold the index's write lock.
+func (tx *Tx) checkUnique() error {
+	stagedIDs := map[string]map[int]bool{}
+	for _, w := range tx.writes {
+		if stagedIDs[w.Model] == nil {
+			stagedIDs[w.Model] = map[int]bool{}
+		}
+		stagedIDs[w.Model][w.ID] = true
+	}
+	owners := map[string]int{}
+	for _, w := range tx.writes {
+		for _, v := range w.Unique {
+			if id, ok := owners[v.Key]; ok && id != w.ID {
+				return &ErrUniqueViolation{Model: w.Model, Field: v.Field, Value: v.Value, ID: id}
+			}
+			owners[v.Key] = w.ID
+		}
+		err := tx.dir.Index.uniqueViolation(w.Model, w.Unique, stagedIDs[w.Model])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyStagedWritesToMatchedIDs removes staged resources from the matched IDs
+// and adds them back if their staged version matches the where clauses and
+// filters.
+func (tx *Tx) applyStagedWritesToMatchedIDs(q *Query) {
+	if q.FatalError != nil {
+		return
+	}
+	matched := map[int]bool{}
+	for _, id := range q.MatchedIDs {
+		matched[id] = true
+	}
+	for _, w := range tx.writes {
+		if w.Model != q.Model {
+			continue
+		}
+		delete(matched, w.ID)
+		if w.Operation == "delete" {
+			continue
+		}
+		candidate := reflect.New(w.ResourceType.Elem()).Interface()
+		q.FatalError = tx.read(candidate, w.ID)
+		if q.FatalError != nil {
+			return
+		}
+		if q.matches(candidate) {
+			matched[w.ID] = true
+		}
+	}
+	q.MatchedIDs = q.MatchedIDs[:0]
+	for id := range matched {
+		q.MatchedIDs = append(q.MatchedIDs, id)
+	}
+	sort.Ints(q.MatchedIDs)
+	if len(q.MatchedIDs) == 0 {
+		q.FatalError = ErrNoMatches
+	}
+}
+
+// isModelPath reports whether path is a model directory or a file below one
+// inside basePath, so that a planted journal can't write elsewhere.
+func isModelPath(basePath string, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(basePath), filepath.Clean(path))
+	return err == nil && !strings.HasPrefix(rel, ".") && !filepath.IsAbs(rel)
+}
+
+func (dir Directory) journalPath() string {
+	return dir.Path + "/.journal"
+}
+
+// applyJournal writes the journal's resources and index log entries to disk.
+// It is idempotent so that it can be repeated after a crash. It returns the
+// number of bytes appended to the index log.
+func (dir Directory) applyJournal(journal *txJournal) (int64, error) {
+	for _, w := range journal.Writes {
+		var err error
+		if w.Delete {
+			err = deleteFromDisk(w.ResourcePath)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = writeToDisk(w.ResourcePath, w.GobBuffer)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	// Drop entries a previous attempt might have appended. If the index has
+	// been compacted since, they are part of the snapshot and appending them
+	// again is harmless.
+	gen, _, err := readIndexLogGen(dir.IndexLogPath)
+	if err != nil {
+		return 0, err
+	}
+	if gen == journal.IndexLogGen {
+		err = os.Truncate(dir.IndexLogPath, journal.IndexLogSize)
+		if err != nil && !(os.IsNotExist(err) && journal.IndexLogSize == 0) {
+			return 0, err
+		}
+	}
+	if len(journal.IndexLogEntries) == 0 {
+		return 0, nil
+	}
+	b, err := dir.formatLogEntries(journal.IndexLogEntries)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(b)), appendToDisk(dir.IndexLogPath, b)
+}
+
+// recoverJournal rolls forward a commit which was interrupted after its
+// journal had been written. Without a journal nothing was written and the
+// transaction is effectively rolled back.
+func (dir Directory) recoverJournal() error {
+	if _, err := os.Stat(dir.journalPath()); os.IsNotExist(err) {
+		return nil
+	}
+
+	journalMutex := locks.get(dir.Path, ".journal")
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+
+	l, err := lockFile(dir.journalPath()+".lock", true, true)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	b, err := readFromDisk(dir.journalPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Journals of directories encrypted before their metadata was are
+	// plaintext.
+	unsealed, err := dir.unseal(b)
+	if err == nil {
+		b = unsealed
+	} else if !dir.plaintextAllowed() {
+		return err
+	}
+	journal := &txJournal{}
+	err = gob.NewDecoder(bytes.NewReader(b)).Decode(journal)
+	if err != nil {
+		return errors.New("Transaction journal is corrupt: " + err.Error())
+	}
+
+	lockPaths := []string{}
+	for _, w := range journal.Writes {
+		for _, path := range []string{w.DirPath, w.ResourcePath} {
+			if !isModelPath(dir.Path, path) {
+				return &ErrPathEscape{Path: path, BasePath: dir.Path}
+			}
+		}
+		lockPaths = append(lockPaths, w.DirPath+"/metadata/lock")
+	}
+	lockPaths = append(uniqueSorted(lockPaths), dir.IndexLogPath+".lock")
+	unlock, err := lockFiles(lockPaths)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, err = dir.applyJournal(journal)
+	if err != nil {
+		return err
+	}
+	return deleteFromDisk(dir.journalPath())
+}
@@ -0,0 +1,86 @@
+// Package gorialize is an embedded database that stores Go structs serialized to gobs
+package gorialize
+
+import (
+	"reflect"
+)
+
+// uniqueValue is the value of a resource's field tagged as unique.
+type uniqueValue struct {
+	Field string
+	Value interface{}
+	Key   string
+}
+
+// uniqueValues returns the values of a resource's unique fields. Each value
+// of a field with several values must be unique on its own.
+func uniqueValues(model string, resourceType reflect.Type, resource interface{}) (values []uniqueValue) {
+	for _, fp := range indexedFields(resourceType) {
+		if !fp.tag.unique {
+			continue
+		}
+		seen := map[string]bool{}
+		for _, value := range fp.values(reflect.Indirect(reflect.ValueOf(resource))) {
+			key := makeKey(model, fp.name, fp.indexValue(value))
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			values = append(values, uniqueValue{
+				Field: fp.name,
+				Value: value.Interface(),
+				Key:   key,
+			})
+		}
+	}
+	return
+}
+
+// ExitIfUniqueViolation fails with *ErrUniqueViolation if another resource
+// already has the value of one of the resource's unique fields. The model's
+// file lock must be held so that no other process writes the model before the
+// resource has been written.
+func (q *Query) ExitIfUniqueViolation() {
+	if q.FatalError != nil {
+		return
+	}
+	values := uniqueValues(q.Model, q.ResourceType, q.Resource)
+	if len(values) == 0 {
+		return
+	}
+	q.FatalError = q.Dir.checkUnique(q.Model, values, map[int]bool{q.ID: true})
+}
+
+// checkUnique catches up with the index log and fails with
+// *ErrUniqueViolation if a resource other than the ignored ones has one of
+// the values.
+func (dir Directory) checkUnique(model string, values []uniqueValue, ignore map[int]bool) error {
+	dir.Index.mutex.Lock()
+	defer dir.Index.mutex.Unlock()
+
+	l, err := lockFile(dir.IndexLogPath+".lock", true, true)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	err = dir.catchUpIndexLog()
+	if err != nil {
+		return err
+	}
+	return dir.Index.uniqueViolation(model, values, ignore)
+}
+
+// uniqueViolation returns an *ErrUniqueViolation if a resource other than the
+// ignored ones has one of the values. The caller must hold at least a read
+// lock on the index.
+func (idx Index) uniqueViolation(model string, values []uniqueValue, ignore map[int]bool) error {
+	for _, v := range values {
+		for _, id := range idx.KV[v.Key] {
+			if !ignore[id] {
+				return &ErrUniqueViolation{Model: model, Field: v.Field, Value: v.Value, ID: id}
+			}
+		}
+	}
+	return nil
+}